@@ -28,6 +28,10 @@ import (
 
 var empty = make([]uint16, 16<<20)
 
+// ErrReadOnly is returned, or panicked with, when modifying a read-only bitmap, like the ones
+// returned by OpenFile.
+var ErrReadOnly = errors.New("bitmap is read-only. Use Clone to get a modifiable copy")
+
 const mask = uint64(0xFFFFFFFFFFFF0000)
 
 type Bitmap struct {
@@ -42,11 +46,48 @@ type Bitmap struct {
 	// memMoved keeps track of how many uint16 moves we had to do. The smaller
 	// this number, the more efficient we have been.
 	memMoved int
+
+	// checksum of data, if the bitmap was created from a buffer with a checksum.
+	checksum    uint32
+	hasChecksum bool
+
+	// readOnly is set if data refers to memory which must not be modified.
+	readOnly bool
+	// copyOnWrite is set if data is shared with another bitmap. It is copied before the first
+	// modification.
+	copyOnWrite bool
+	// copied is set if the buffer given to FromBuffer had to be copied.
+	copied bool
+}
+
+// ensureWritable must be called before modifying the bitmap. It panics with ErrReadOnly if the
+// bitmap is read-only, and copies the buffer if it is shared.
+func (ra *Bitmap) ensureWritable() {
+	if ra.readOnly {
+		panic(ErrReadOnly)
+	}
+	if ra.copyOnWrite {
+		data := make([]uint16, len(ra.data))
+		copy(data, ra.data)
+		ra.setData(data)
+		ra.copyOnWrite = false
+	}
 }
 
 // FromBuffer returns a pointer to bitmap corresponding to the given buffer. This bitmap shouldn't
-// be modified because it might corrupt the given buffer.
+// be modified because it might corrupt the given buffer. Use FromBufferImmutable to enforce that.
+// The buffer may start with the header written by ToBufferWithHeader. FromBuffer panics if it
+// can't understand the header.
 func FromBuffer(data []byte) *Bitmap {
+	h, data, err := readHeader(data)
+	if err != nil {
+		panic(errors.Wrap(err, "FromBuffer"))
+	}
+	return fromBufferWithHeader(h, data)
+}
+
+// fromBuffer is the same as FromBuffer, but expects a buffer without the header.
+func fromBuffer(data []byte) *Bitmap {
 	assert(len(data)%2 == 0)
 	if len(data) < 8 {
 		return NewBitmap()
@@ -63,13 +104,22 @@ func FromBuffer(data []byte) *Bitmap {
 // FromBufferWithCopy creates a copy of the given buffer and returns a bitmap based on the copied
 // buffer. This bitmap is safe for both read and write operations.
 func FromBufferWithCopy(src []byte) *Bitmap {
+	h, src, err := readHeader(src)
+	if err != nil {
+		panic(errors.Wrap(err, "FromBufferWithCopy"))
+	}
+	_, src, copied := toReadable(h, src)
 	assert(len(src)%2 == 0)
 	if len(src) < 8 {
 		return NewBitmap()
 	}
-	src16 := toUint16Slice(src)
-	dst16 := make([]uint16, len(src16))
-	copy(dst16, src16)
+	// toReadable copies the buffer if it needs to convert it. Otherwise, copy it here.
+	if !copied {
+		dst := AlignedBuffer(len(src))
+		copy(dst, src)
+		src = dst
+	}
+	dst16 := toUint16Slice(src)
 	x := toUint64Slice(dst16[:4])[indexNodeSize]
 
 	return &Bitmap{
@@ -78,20 +128,22 @@ func FromBufferWithCopy(src []byte) *Bitmap {
 	}
 }
 
+// ToBuffer returns the buffer of the bitmap in little-endian byte order, which can be read by
+// FromBuffer on any host. On little-endian hosts, it refers to the memory of the bitmap without
+// copying it. On big-endian hosts, it is a converted copy.
 func (ra *Bitmap) ToBuffer() []byte {
 	if ra.IsEmpty() {
 		return nil
 	}
-	return toByteSlice(ra.data)
+	return toLittleEndian(ra.data)
 }
 
+// ToBufferWithCopy is the same as ToBuffer, but it always returns a copy.
 func (ra *Bitmap) ToBufferWithCopy() []byte {
 	if ra.IsEmpty() {
 		return nil
 	}
-	buf := make([]uint16, len(ra.data))
-	copy(buf, ra.data)
-	return toByteSlice(buf)
+	return littleEndianCopy(ra.data)
 }
 
 func NewBitmap() *Bitmap {
@@ -239,7 +291,15 @@ func (ra *Bitmap) expandContainer(offset uint64) {
 		panic("Container size should NOT be zero")
 	}
 	bySize := uint16(sz)
-	if sz >= 2048 {
+	toBitmap := sz >= 2048
+	if ra.getContainer(offset)[indexType] == typeRun {
+		// A run container with up to maxRuns-1 runs is smaller than a bitmap container. So, keep
+		// growing it till then.
+		maxSz := uint16(runContainerSize(maxRuns - 1))
+		toBitmap = sz >= maxSz
+		bySize = min16(sz, maxSz-sz)
+	}
+	if toBitmap {
 		// Size is in uint16. Half of max allowed size. If we're expanding the container by more
 		// than 2048, we should just cap it to max size of 4096.
 		assert(sz < maxContainerSize)
@@ -250,13 +310,19 @@ func (ra *Bitmap) expandContainer(offset uint64) {
 	ra.scootRight(offset+uint64(sz), uint64(bySize))
 	ra.keys.updateOffsets(offset, uint64(bySize), true)
 
-	if sz < 2048 {
+	if !toBitmap {
 		ra.data[offset] = sz + bySize
 
 	} else {
 		// Convert to bitmap container.
-		src := array(ra.getContainer(offset))
-		buf := src.toBitmapContainer(nil)
+		var buf []uint16
+		src := ra.getContainer(offset)
+		switch src[indexType] {
+		case typeArray:
+			buf = array(src).toBitmapContainer(nil)
+		case typeRun:
+			buf = run(src).toBitmapContainer(nil)
+		}
 		assert(copy(ra.data[offset:], buf) == maxContainerSize)
 	}
 }
@@ -281,7 +347,7 @@ func stepSize(n uint16) uint16 {
 
 // copyAt would copy over a given container via src, into the container at
 // offset. If src is a bitmap, it would copy it over directly. If src is an
-// array container, then it would follow these paths:
+// array or a run container, then it would follow these paths:
 // - If src is smaller than dst, copy it over.
 // - If not, look for target size for dst using the stepSize function.
 // - If target size is maxSize, then convert src to a bitmap container, and
@@ -318,10 +384,13 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 		targetSz = stepSize(targetSz)
 	}
 
+	if targetSz == maxContainerSize && src[indexType] == typeRun {
+		// A run container is smaller than a bitmap container, so keep it as a run container.
+		targetSz = src[indexSize]
+	}
+
 	if targetSz == maxContainerSize {
 		// Looks like the targetSize is now maxSize. So, convert src to bitmap container.
-		s := array(src)
-
 		bySize := uint16(maxContainerSize) - dstSize
 		// Select the portion to the right of the container, beyond its right boundary.
 		ra.scootRight(offset+uint64(dstSize), uint64(bySize))
@@ -330,14 +399,19 @@ func (ra *Bitmap) copyAt(offset uint64, src []uint16) {
 		// Update the space of the container, so getContainer would work correctly.
 		ra.data[offset] = maxContainerSize
 
-		// Convert the src array to bitmap and write it directly over to the container.
+		// Convert the src to bitmap and write it directly over to the container.
 		out := ra.getContainer(offset)
 		Memclr(out)
-		s.toBitmapContainer(out)
+		switch src[indexType] {
+		case typeArray:
+			array(src).toBitmapContainer(out)
+		case typeRun:
+			run(src).toBitmapContainer(out)
+		}
 		return
 	}
 
-	// targetSize is not maxSize. Let's expand to targetSize and copy array.
+	// targetSize is not maxSize. Let's expand to targetSize and copy src.
 	bySize := targetSz - dstSize
 	ra.scootRight(offset+uint64(dstSize), uint64(bySize))
 	ra.keys.updateOffsets(offset, uint64(bySize), true)
@@ -355,10 +429,13 @@ func (ra Bitmap) getContainer(offset uint64) []uint16 {
 }
 
 func (ra *Bitmap) Clone() *Bitmap {
-	abuf := ra.ToBuffer()
-	bbuf := make([]byte, len(abuf))
-	copy(bbuf, abuf)
-	return FromBuffer(bbuf)
+	if ra.IsEmpty() {
+		return NewBitmap()
+	}
+	// Copy the buffer in the byte order of the host, so that it doesn't need to be converted.
+	data := make([]uint16, len(ra.data))
+	copy(data, ra.data)
+	return FromBuffer(toByteSlice(data))
 }
 
 func (ra *Bitmap) IsEmpty() bool {
@@ -377,6 +454,7 @@ func (ra *Bitmap) IsEmpty() bool {
 }
 
 func (ra *Bitmap) Set(x uint64) bool {
+	ra.ensureWritable()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -399,11 +477,31 @@ func (ra *Bitmap) Set(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.add(uint16(x))
+	case typeRun:
+		r := run(c)
+		if added := r.add(uint16(x)); !added {
+			return false
+		}
+		if r.isFull() {
+			ra.expandContainer(offset)
+		}
+		return true
 	}
 	panic("we shouldn't reach here")
 }
 
+// FromSortedList returns a bitmap containing the given sorted values.
 func FromSortedList(vals []uint64) *Bitmap {
+	return fromSortedList(vals, false)
+}
+
+// FromSortedListWithRuns is the same as FromSortedList, but it also uses run containers wherever
+// they take less space than array or bitmap containers.
+func FromSortedListWithRuns(vals []uint64) *Bitmap {
+	return fromSortedList(vals, true)
+}
+
+func fromSortedList(vals []uint64, useRuns bool) *Bitmap {
 	var arr []uint16
 	var hi, lastHi, off uint64
 
@@ -428,7 +526,17 @@ func FromSortedList(vals []uint64) *Bitmap {
 		if len(l) == 0 {
 			return
 		}
+		// Size of the container, if we don't use run containers.
+		sz := maxContainerSize
 		if len(l) <= 2048 {
+			sz = 8 + len(l)
+		}
+		if useRuns && runContainerSize(numRuns(l)) < sz {
+			r := runContainerFrom(toRuns(l))
+			off = ra.newContainer(uint16(len(r)))
+			copy(ra.getContainer(off), r)
+
+		} else if len(l) <= 2048 {
 			// 4 uint16s for the header, and extra 4 uint16s so that adding more elements using
 			// Set operation doesn't fail.
 			sz := uint16(8 + len(l))
@@ -489,19 +597,26 @@ func (ra *Bitmap) Select(x uint64) (uint64, error) {
 		c := uint64(getCardinality(con))
 		assert(c != uint64(invalidCardinality))
 		if x < c {
-			key := ra.keys.key(i)
-			switch con[indexType] {
-			case typeArray:
-				return key | uint64(array(con).all()[x]), nil
-			case typeBitmap:
-				return key | uint64(bitmap(con).selectAt(int(x))), nil
-			}
+			return ra.keys.key(i) | uint64(selectContainer(con, int(x))), nil
 		}
 		x -= c
 	}
 	panic("should not reach here")
 }
 
+// selectContainer returns the element at the xth index in the container.
+func selectContainer(con []uint16, x int) uint16 {
+	switch con[indexType] {
+	case typeArray:
+		return array(con).all()[x]
+	case typeBitmap:
+		return bitmap(con).selectAt(x)
+	case typeRun:
+		return run(con).selectAt(x)
+	}
+	panic("should not reach here")
+}
+
 func (ra *Bitmap) Contains(x uint64) bool {
 	if ra == nil {
 		return false
@@ -521,6 +636,9 @@ func (ra *Bitmap) Contains(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.has(y)
+	case typeRun:
+		r := run(c)
+		return r.has(y)
 	}
 	return false
 }
@@ -529,6 +647,7 @@ func (ra *Bitmap) Remove(x uint64) bool {
 	if ra == nil {
 		return false
 	}
+	ra.ensureWritable()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -542,15 +661,147 @@ func (ra *Bitmap) Remove(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.remove(uint16(x))
+	case typeRun:
+		r := run(c)
+		if removed := r.remove(uint16(x)); !removed {
+			return false
+		}
+		// Removal might have split a run. Ensure there's space for another run.
+		if r.isFull() {
+			ra.expandContainer(offset)
+		}
+		return true
 	}
 	return true
 }
 
+// FromRange returns a bitmap containing all the integers in [lo, hi).
+func FromRange(lo, hi uint64) *Bitmap {
+	ra := NewBitmap()
+	if lo >= hi {
+		return ra
+	}
+	// Set the keys beforehand so that we don't need to move a lot of memory because of adding keys.
+	k1, k2 := lo&mask, (hi-1)&mask
+	numKeys := int((k2-k1)>>16) + 1
+	if k1 == 0 {
+		numKeys--
+	}
+	ra.initSpaceForKeys(numKeys)
+	ra.AddRange(lo, hi)
+	return ra
+}
+
+// AddRange adds [lo, hi) to the bitmap. The containers which lie completely within the range are
+// replaced by run containers. Only the containers at the edges of the range are merged with the
+// range.
+func (ra *Bitmap) AddRange(lo, hi uint64) {
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	ra.ensureWritable()
+	forEachRange(lo, hi, ra.addRange)
+}
+
+// forEachRange splits [lo, hi) into ranges which lie within a single container, and calls fn with
+// the key of the container and the range [lo, hi] within the container.
+func forEachRange(lo, hi uint64, fn func(key uint64, lo, hi uint16)) {
+	if lo == hi {
+		return
+	}
+
+	k1 := lo & mask
+	k2 := (hi - 1) & mask
+
+	//  Complete range lie in a single container
+	if k1 == k2 {
+		fn(k1, uint16(lo), uint16(hi-1))
+		return
+	}
+
+	fn(k1, uint16(lo), math.MaxUint16)
+	for k := k1 + (1 << 16); k < k2; k += 1 << 16 {
+		fn(k, 0, math.MaxUint16)
+	}
+	fn(k2, 0, uint16(hi-1))
+}
+
+// addRange adds [lo, hi] to the container corresponding to the given key.
+func (ra *Bitmap) addRange(key uint64, lo, hi uint16) {
+	offset, has := ra.keys.getValue(key)
+	if !has {
+		r := runContainerFrom([]uint16{lo, hi})
+		o := ra.newContainer(uint16(len(r)))
+		copy(ra.data[o:], r)
+		ra.setKey(key, o)
+		return
+	}
+
+	c := ra.getContainer(offset)
+	var out []uint16
+	switch c[indexType] {
+	case typeArray:
+		out = runContainerFrom(runsOr(array(c).toRuns(), []uint16{lo, hi}))
+	case typeBitmap:
+		b := bitmap(c)
+		setCardinality(b, getCardinality(b)+b.setRange(lo, hi))
+		return
+	case typeRun:
+		out = runContainerFrom(runsOr(run(c).runs(), []uint16{lo, hi}))
+	}
+	// The range might not have merged with the existing elements well. So, pick the smallest
+	// encoding for the result.
+	ra.copyAt(offset, optimizeContainer(out))
+}
+
+// Flip negates the membership of all the integers in [lo, hi). So, the integers in the range which
+// are present in the bitmap are removed, and the ones which are absent are added.
+func (ra *Bitmap) Flip(lo, hi uint64) {
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	ra.ensureWritable()
+	forEachRange(lo, hi, ra.flipRange)
+	ra.Cleanup()
+}
+
+// Flip returns a new bitmap, which is bm with the membership of all the integers in [lo, hi)
+// negated. bm is not modified.
+func Flip(bm *Bitmap, lo, hi uint64) *Bitmap {
+	res := bm.Clone()
+	res.Flip(lo, hi)
+	return res
+}
+
+// flipRange flips [lo, hi] in the container corresponding to the given key.
+func (ra *Bitmap) flipRange(key uint64, lo, hi uint16) {
+	offset, has := ra.keys.getValue(key)
+	if !has {
+		ra.addRange(key, lo, hi)
+		return
+	}
+
+	c := ra.getContainer(offset)
+	var out []uint16
+	switch c[indexType] {
+	case typeArray:
+		out = runContainerFrom(runsXor(array(c).toRuns(), []uint16{lo, hi}))
+	case typeBitmap:
+		b := bitmap(c)
+		setCardinality(b, getCardinality(b)+b.flipRange(lo, hi))
+		return
+	case typeRun:
+		out = runContainerFrom(runsXor(run(c).runs(), []uint16{lo, hi}))
+	}
+	ra.copyAt(offset, optimizeContainer(out))
+}
+
 // Remove range removes [lo, hi) from the bitmap.
 func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 	if lo > hi {
 		panic("lo should not be more than hi")
 	}
+	ra.ensureWritable()
 	if lo == hi {
 		return
 	}
@@ -565,6 +816,10 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 		if off, has := ra.keys.getValue(k1); has {
 			c := ra.getContainer(off)
 			removeRangeContainer(c, uint16(lo), uint16(hi)-1)
+			// Removal might have split a run. Ensure there's space for another run.
+			if c[indexType] == typeRun && run(c).isFull() {
+				ra.expandContainer(off)
+			}
 		}
 		return
 	}
@@ -609,6 +864,7 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 }
 
 func (ra *Bitmap) Reset() {
+	ra.ensureWritable()
 	// reset ra.data to size enough for one container and corresponding key.
 	// 2 u64 is needed for header and another 2 u16 for the key 0.
 	ra.data = ra.data[:16+minContainerSize]
@@ -656,6 +912,13 @@ func (ra *Bitmap) ToArray() []uint64 {
 			for _, x := range out {
 				res = append(res, key|uint64(x))
 			}
+		case typeRun:
+			r := run(c)
+			for i := 0; i < r.numRuns(); i++ {
+				for x := int(r.start(i)); x <= int(r.last(i)); x++ {
+					res = append(res, key|uint64(x))
+				}
+			}
 		}
 	}
 	return res
@@ -765,12 +1028,19 @@ func (ra *Bitmap) extreme(dir int) uint64 {
 			return k | uint64(b.minimum())
 		}
 		return k | uint64(b.maximum())
+	case typeRun:
+		r := run(c)
+		if dir == fwd {
+			return k | uint64(r.minimum())
+		}
+		return k | uint64(r.maximum())
 	default:
 		panic("We don't support this type of container")
 	}
 }
 
 func (ra *Bitmap) And(bm *Bitmap) {
+	ra.ensureWritable()
 	if bm == nil {
 		ra.Reset()
 		return
@@ -822,7 +1092,7 @@ func And(a, b *Bitmap) *Bitmap {
 	res := NewBitmap()
 	for ai < an && bi < bn {
 		ak := a.keys.key(ai)
-		bk := a.keys.key(bi)
+		bk := b.keys.key(bi)
 		if ak == bk {
 			// Do the intersection.
 			off := a.keys.val(ai)
@@ -849,6 +1119,7 @@ func And(a, b *Bitmap) *Bitmap {
 }
 
 func (ra *Bitmap) AndNot(bm *Bitmap) {
+	ra.ensureWritable()
 	if bm == nil {
 		return
 	}
@@ -885,8 +1156,231 @@ func (ra *Bitmap) AndNot(bm *Bitmap) {
 	}
 }
 
+// AndNot returns a new bitmap with the elements of a which are not present in b. Neither a nor b
+// is modified.
+func AndNot(a, b *Bitmap) *Bitmap {
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	buf := make([]uint16, maxContainerSize)
+	// containerAndNot might modify the left container in place. So, we copy it over to scratch.
+	scratch := make([]uint16, maxContainerSize)
+	res := NewBitmap()
+	for ai < an {
+		ak := a.keys.key(ai)
+		ac := a.getContainer(a.keys.val(ai))
+		for bi < bn && b.keys.key(bi) < ak {
+			bi++
+		}
+
+		outc := ac
+		if bi < bn && b.keys.key(bi) == ak {
+			bc := b.getContainer(b.keys.val(bi))
+			copy(scratch, ac)
+			outc = containerAndNot(scratch[:len(ac)], bc, buf)
+		}
+		if getCardinality(outc) > 0 {
+			offset := res.newContainer(uint16(len(outc)))
+			copy(res.data[offset:], outc)
+			res.setKey(ak, offset)
+		}
+		ai++
+	}
+	return res
+}
+
+// Xor computes the symmetric difference of ra and bm, and stores the result in ra.
+func (ra *Bitmap) Xor(bm *Bitmap) {
+	ra.ensureWritable()
+	if bm == nil {
+		return
+	}
+	buf := make([]uint16, maxContainerSize)
+	for bi := 0; bi < bm.keys.numKeys(); bi++ {
+		bc := bm.getContainer(bm.keys.val(bi))
+		if getCardinality(bc) == 0 {
+			continue
+		}
+		bk := bm.keys.key(bi)
+
+		var c []uint16
+		if off, has := ra.keys.getValue(bk); has {
+			c = containerXor(ra.getContainer(off), bc, buf)
+		} else {
+			// The container doesn't exist in ra. So, copy it over.
+			c = bc
+		}
+		// create a new container and update the key offset to this container.
+		offset := ra.newContainer(uint16(len(c)))
+		copy(ra.data[offset:], c)
+		ra.setKey(bk, offset)
+	}
+}
+
+// Xor returns a new bitmap with the elements which are present in exactly one of a and b. Neither
+// a nor b is modified.
+func Xor(a, b *Bitmap) *Bitmap {
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+
+	buf := make([]uint16, maxContainerSize)
+	res := NewBitmap()
+	add := func(key uint64, c []uint16) {
+		if getCardinality(c) == 0 {
+			return
+		}
+		offset := res.newContainer(uint16(len(c)))
+		copy(res.data[offset:], c)
+		res.setKey(key, offset)
+	}
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		ac := a.getContainer(a.keys.val(ai))
+
+		bk := b.keys.key(bi)
+		bc := b.getContainer(b.keys.val(bi))
+
+		if ak == bk {
+			add(ak, containerXor(ac, bc, buf))
+			ai++
+			bi++
+		} else if ak < bk {
+			add(ak, ac)
+			ai++
+		} else {
+			add(bk, bc)
+			bi++
+		}
+	}
+	for ; ai < an; ai++ {
+		add(a.keys.key(ai), a.getContainer(a.keys.val(ai)))
+	}
+	for ; bi < bn; bi++ {
+		add(b.keys.key(bi), b.getContainer(b.keys.val(bi)))
+	}
+	return res
+}
+
+// AndCardinality returns the cardinality of the intersection of ra and bm. It doesn't materialize
+// the intersection, and doesn't allocate any memory.
+func (ra *Bitmap) AndCardinality(bm *Bitmap) int {
+	if ra == nil || bm == nil {
+		return 0
+	}
+	ai, an := 0, ra.keys.numKeys()
+	bi, bn := 0, bm.keys.numKeys()
+
+	var card int
+	for ai < an && bi < bn {
+		ak := ra.keys.key(ai)
+		bk := bm.keys.key(bi)
+		if ak == bk {
+			ac := ra.getContainer(ra.keys.val(ai))
+			bc := bm.getContainer(bm.keys.val(bi))
+			card += containerAndCardinality(ac, bc)
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return card
+}
+
+// Intersects returns true if ra and bm have at least one element in common. It returns as soon as
+// a common element is found, and doesn't modify either of the bitmaps. So, it can be used on the
+// bitmaps created via FromBuffer.
+func (ra *Bitmap) Intersects(bm *Bitmap) bool {
+	if ra == nil || bm == nil {
+		return false
+	}
+	ai, an := 0, ra.keys.numKeys()
+	bi, bn := 0, bm.keys.numKeys()
+
+	for ai < an && bi < bn {
+		ak := ra.keys.key(ai)
+		bk := bm.keys.key(bi)
+		if ak == bk {
+			ac := ra.getContainer(ra.keys.val(ai))
+			bc := bm.getContainer(bm.keys.val(bi))
+			if containerIntersects(ac, bc) {
+				return true
+			}
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return false
+}
+
+// IsSubsetOf returns true if all the elements of ra are present in bm. The comparison is done
+// logically, so it doesn't depend upon the type of the containers or their layout in the buffer.
+func (ra *Bitmap) IsSubsetOf(bm *Bitmap) bool {
+	if ra.IsEmpty() {
+		return true
+	}
+	if bm == nil {
+		return false
+	}
+	bi, bn := 0, bm.keys.numKeys()
+	for ai := 0; ai < ra.keys.numKeys(); ai++ {
+		ac := ra.getContainer(ra.keys.val(ai))
+		card := getCardinality(ac)
+		if card == 0 {
+			continue
+		}
+		ak := ra.keys.key(ai)
+		for bi < bn && bm.keys.key(bi) < ak {
+			bi++
+		}
+		if bi == bn || bm.keys.key(bi) != ak {
+			return false
+		}
+		bc := bm.getContainer(bm.keys.val(bi))
+		if card > getCardinality(bc) || containerAndCardinality(ac, bc) != card {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSupersetOf returns true if all the elements of bm are present in ra.
+func (ra *Bitmap) IsSupersetOf(bm *Bitmap) bool {
+	return bm.IsSubsetOf(ra)
+}
+
+// Equals returns true if ra and bm contain the same elements. Unlike comparing the output of
+// ToBuffer, it ignores the differences in container types, empty containers and unused space.
+func (ra *Bitmap) Equals(bm *Bitmap) bool {
+	return ra.GetCardinality() == bm.GetCardinality() && ra.IsSubsetOf(bm)
+}
+
+// OrCardinality returns the cardinality of the union of ra and bm, without materializing it.
+func (ra *Bitmap) OrCardinality(bm *Bitmap) int {
+	return ra.GetCardinality() + bm.GetCardinality() - ra.AndCardinality(bm)
+}
+
+// AndNotCardinality returns the number of elements in ra which are not in bm, without
+// materializing them.
+func (ra *Bitmap) AndNotCardinality(bm *Bitmap) int {
+	return ra.GetCardinality() - ra.AndCardinality(bm)
+}
+
+// XorCardinality returns the cardinality of the symmetric difference of ra and bm, without
+// materializing it.
+func (ra *Bitmap) XorCardinality(bm *Bitmap) int {
+	return ra.GetCardinality() + bm.GetCardinality() - 2*ra.AndCardinality(bm)
+}
+
 // TODO: Check if we want to use lazyMode
 func (dst *Bitmap) Or(src Bitmap) {
+	dst.ensureWritable()
 	if src.IsEmpty() {
 		return
 	}
@@ -993,6 +1487,8 @@ func (ra *Bitmap) Rank(x uint64) int {
 		rank = array(c).rank(y)
 	case typeBitmap:
 		rank = bitmap(c).rank(y)
+	case typeRun:
+		rank = run(c).rank(y)
 	}
 	if rank < 0 {
 		return -1
@@ -1010,7 +1506,80 @@ func (ra *Bitmap) Rank(x uint64) int {
 	return rank
 }
 
+// RunOptimize converts every container into whichever of array, bitmap or run encoding takes the
+// least space. It then rewrites ra.data, so that the containers are laid out back to back in the
+// order of their keys. Empty containers are dropped.
+func (ra *Bitmap) RunOptimize() {
+	ra.ensureWritable()
+	ra.setData(ra.rebuild(optimizeContainer))
+}
+
+// Compact rewrites ra.data, so that the key node and the containers don't keep any unused space,
+// apart from the space for one more element, and the empty containers are dropped. The container
+// types are kept as is.
+func (ra *Bitmap) Compact() {
+	ra.ensureWritable()
+	ra.setData(ra.rebuild(compactContainer))
+}
+
+// ToCompactBuffer returns a compacted copy of the bitmap's buffer, as if Compact was called on it,
+// without modifying the bitmap. The buffer can be read by FromBuffer.
+func (ra *Bitmap) ToCompactBuffer() []byte {
+	if ra.IsEmpty() {
+		return nil
+	}
+	return toLittleEndian(ra.rebuild(compactContainer))
+}
+
+// setData replaces the buffer of the bitmap with data.
+func (ra *Bitmap) setData(data []uint16) {
+	ra.data = data
+	ra.keys = toUint64Slice(data[:toUint64Slice(data)[indexNodeSize]])
+	ra._ptr = nil
+	// The checksum belongs to the previous buffer.
+	ra.hasChecksum = false
+}
+
+// rebuild returns a new buffer for the bitmap, where every container is replaced by fn(container)
+// and laid out back to back. The empty containers are left out, except for the 0 key. The key node
+// only keeps enough space for one more key, so that it is never full.
+func (ra *Bitmap) rebuild(fn func(c []uint16) []uint16) []uint16 {
+	n := ra.keys.numKeys()
+	keys := make([]uint64, 0, n)
+	conts := make([][]uint16, 0, n)
+	var sz int
+	for i := 0; i < n; i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		// We never remove the 0 key.
+		if i > 0 && getCardinality(c) == 0 {
+			continue
+		}
+		oc := fn(c)
+		keys = append(keys, ra.keys.key(i))
+		conts = append(conts, oc)
+		sz += len(oc)
+	}
+
+	// 2 uint64s for the node size and the number of keys, and 2 uint64s for each key, along with
+	// the extra one.
+	nodeSz := 4 * (indexNodeStart + 2*(len(keys)+1))
+	data := make([]uint16, nodeSz+sz)
+	keyNode := node(toUint64Slice(data[:nodeSz]))
+	keyNode.setNodeSize(nodeSz)
+	keyNode.setNumKeys(len(keys))
+
+	offset := uint64(nodeSz)
+	for i, c := range conts {
+		copy(data[offset:], c)
+		keyNode.setAt(keyOffset(i), keys[i])
+		keyNode.setAt(valOffset(i), offset)
+		offset += uint64(len(c))
+	}
+	return data
+}
+
 func (ra *Bitmap) Cleanup() {
+	ra.ensureWritable()
 	type interval struct {
 		start uint64
 		end   uint64
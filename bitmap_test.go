@@ -3,6 +3,7 @@ package sroar
 import (
 	"math"
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -871,3 +872,749 @@ func TestSplit(t *testing.T) {
 	run(1e3)
 	run(1e6)
 }
+
+// runify returns a copy of the bitmap, with all its containers converted to run containers.
+func runify(ra *Bitmap) *Bitmap {
+	res := ra.Clone()
+	for i := 0; i < res.keys.numKeys(); i++ {
+		c := res.getContainer(res.keys.val(i))
+		var r []uint16
+		switch c[indexType] {
+		case typeArray:
+			r = array(c).toRunContainer()
+		case typeBitmap:
+			r = bitmap(c).toRunContainer()
+		default:
+			continue
+		}
+		off := res.newContainer(uint16(len(r)))
+		copy(res.data[off:], r)
+		res.setKey(res.keys.key(i), off)
+	}
+	return res
+}
+
+// clustered returns a bitmap with n runs of random length in [0, max).
+func clustered(n int, max int64) *Bitmap {
+	bm := NewBitmap()
+	for i := 0; i < n; i++ {
+		start := uint64(rand.Int63n(max))
+		for x := start; x < start+uint64(rand.Intn(300)); x++ {
+			bm.Set(x)
+		}
+	}
+	return bm
+}
+
+func TestRunContainer(t *testing.T) {
+	r := run(make([]uint16, runContainerSize(maxRuns-1)))
+	r[indexSize] = uint16(len(r))
+	r[indexType] = typeRun
+
+	m := make(map[uint16]struct{})
+	for i := 0; i < 3000; i++ {
+		x := uint16(rand.Intn(2000))
+		_, has := m[x]
+		if rand.Intn(3) == 0 {
+			require.Equal(t, has, r.remove(x))
+			delete(m, x)
+		} else {
+			require.Equal(t, !has, r.add(x))
+			m[x] = struct{}{}
+		}
+		require.Equal(t, len(m), getCardinality(r))
+	}
+	require.Equal(t, len(m), r.cardinality())
+
+	all := r.all()
+	require.Equal(t, len(m), len(all))
+	for i, x := range all {
+		require.True(t, r.has(x))
+		require.Equal(t, i, r.rank(x))
+		require.Equal(t, x, r.selectAt(i))
+	}
+	for x := 0; x < 2000; x++ {
+		_, has := m[uint16(x)]
+		require.Equal(t, has, r.has(uint16(x)))
+	}
+
+	require.Equal(t, all, array(r.toArrayContainer()).all())
+	require.Equal(t, all, bitmap(r.toBitmapContainer(nil)).all())
+	require.Equal(t, r.runs(), run(array(r.toArrayContainer()).toRunContainer()).runs())
+	require.Equal(t, r.runs(), run(bitmap(r.toBitmapContainer(nil)).toRunContainer()).runs())
+}
+
+func TestRunContainerRemoveRange(t *testing.T) {
+	type cases struct {
+		lo       uint16
+		hi       uint16
+		expected []uint16
+	}
+
+	tests := []cases{
+		{0, 9, []uint16{10, 20, 30, 40}},
+		{0, 10, []uint16{11, 20, 30, 40}},
+		{12, 18, []uint16{10, 11, 19, 20, 30, 40}},
+		{15, 35, []uint16{10, 14, 36, 40}},
+		{21, 29, []uint16{10, 20, 30, 40}},
+		{20, 30, []uint16{10, 19, 31, 40}},
+		{0, 100, []uint16{}},
+	}
+
+	for _, tc := range tests {
+		r := run(runContainerFrom([]uint16{10, 20, 30, 40}))
+		r.removeRange(tc.lo, tc.hi)
+		require.Equalf(t, tc.expected, append([]uint16{}, r.runs()...), "case: %+v", tc)
+		require.Equal(t, r.cardinality(), getCardinality(r))
+	}
+}
+
+func TestRunBitmap(t *testing.T) {
+	a := clustered(500, 1<<20)
+	r := runify(a)
+	require.Equal(t, a.GetCardinality(), r.GetCardinality())
+	require.Equal(t, a.ToArray(), r.ToArray())
+	require.Equal(t, a.Minimum(), r.Minimum())
+	require.Equal(t, a.Maximum(), r.Maximum())
+
+	var n int
+	for i := 0; i < r.keys.numKeys(); i++ {
+		if r.getContainer(r.keys.val(i))[indexType] == typeRun {
+			n++
+		}
+	}
+	require.Greater(t, n, 0)
+
+	arr := a.ToArray()
+	for i, x := range arr {
+		require.True(t, r.Contains(x))
+		require.Equal(t, i, r.Rank(x))
+		val, err := r.Select(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, x, val)
+	}
+
+	itr := r.NewIterator()
+	for _, x := range arr {
+		val, ok := itr.Next()
+		require.True(t, ok)
+		require.Equal(t, x, val)
+	}
+	_, ok := itr.Next()
+	require.False(t, ok)
+
+	// Modify both the bitmaps in the same way.
+	for i := 0; i < 10000; i++ {
+		x := uint64(rand.Int63n(1 << 20))
+		if rand.Intn(2) == 0 {
+			require.Equal(t, a.Set(x), r.Set(x))
+		} else {
+			require.Equal(t, a.Remove(x), r.Remove(x))
+		}
+	}
+	require.Equal(t, a.ToArray(), r.ToArray())
+
+	lo := uint64(rand.Int63n(1 << 20))
+	hi := lo + uint64(rand.Int63n(1<<10))
+	a.RemoveRange(lo, hi)
+	r.RemoveRange(lo, hi)
+	require.Equal(t, a.ToArray(), r.ToArray())
+
+	a.RemoveRange(1<<10, 1<<19)
+	r.RemoveRange(1<<10, 1<<19)
+	require.Equal(t, a.ToArray(), r.ToArray())
+}
+
+func TestRunBitmapSetAll(t *testing.T) {
+	// Keep adding alternate elements to a run container, so that it gets converted to a bitmap.
+	r := runify(FromSortedList([]uint64{1, 2, 3}))
+	for x := uint64(0); x < 1<<16; x += 2 {
+		r.Set(x)
+	}
+	require.Equal(t, 1<<15+2, r.GetCardinality())
+	require.True(t, r.Contains(3))
+	require.Equal(t, typeBitmap, r.getContainer(r.keys.val(0))[indexType])
+}
+
+func TestRunOrArray(t *testing.T) {
+	a := FromRange(0, 100)
+	b := FromSortedList([]uint64{500})
+	typ := func(bm *Bitmap) uint16 {
+		return bm.getContainer(bm.keys.val(0))[indexType]
+	}
+
+	for _, res := range []*Bitmap{Or(a, b), Or(b, a)} {
+		require.Equal(t, 101, res.GetCardinality())
+		require.Equal(t, uint16(typeRun), typ(res))
+		require.NoError(t, validate(res.data))
+	}
+	c := a.Clone()
+	c.Or(*b)
+	require.Equal(t, uint16(typeRun), typ(c))
+	require.Equal(t, 101, c.GetCardinality())
+	require.NoError(t, validate(c.data))
+
+	// Growing a run container keeps it as a run container, as long as it is smaller than a bitmap.
+	c = runify(FromRange(0, 2))
+	for i := uint64(1); i < uint64(maxRuns-1); i++ {
+		c.Set(4 * i)
+		c.Set(4*i + 1)
+	}
+	require.Equal(t, uint16(typeRun), typ(c))
+	require.Greater(t, len(c.getContainer(c.keys.val(0))), 2048)
+	require.Equal(t, 2*(maxRuns-1), c.GetCardinality())
+	require.NoError(t, validate(c.data))
+	c.Set(4 * uint64(maxRuns))
+	require.Equal(t, uint16(typeBitmap), typ(c))
+	require.Equal(t, 2*(maxRuns-1)+1, c.GetCardinality())
+	require.NoError(t, validate(c.data))
+}
+
+func TestRunBitmapOps(t *testing.T) {
+	toMap := func(bm *Bitmap) map[uint64]struct{} {
+		m := make(map[uint64]struct{})
+		for _, x := range bm.ToArray() {
+			m[x] = struct{}{}
+		}
+		return m
+	}
+
+	check := func(a, b *Bitmap) {
+		ma, mb := toMap(a), toMap(b)
+		var and, or, andNot, xor []uint64
+		for x := range ma {
+			or = append(or, x)
+			if _, has := mb[x]; has {
+				and = append(and, x)
+			} else {
+				andNot = append(andNot, x)
+				xor = append(xor, x)
+			}
+		}
+		for x := range mb {
+			if _, has := ma[x]; !has {
+				or = append(or, x)
+				xor = append(xor, x)
+			}
+		}
+		sorted := func(arr []uint64) []uint64 {
+			arr = append([]uint64{}, arr...)
+			sort.Slice(arr, func(i, j int) bool { return arr[i] < arr[j] })
+			return arr
+		}
+
+		require.Equal(t, len(and), And(a, b).GetCardinality())
+		require.Equal(t, sorted(and), sorted(And(a, b).ToArray()))
+		require.Equal(t, sorted(or), sorted(Or(a, b).ToArray()))
+
+		res := a.Clone()
+		res.And(b)
+		require.Equal(t, sorted(and), sorted(res.ToArray()))
+
+		res = a.Clone()
+		res.Or(*b)
+		require.Equal(t, sorted(or), sorted(res.ToArray()))
+
+		res = a.Clone()
+		res.AndNot(b)
+		require.Equal(t, sorted(andNot), sorted(res.ToArray()))
+
+		res = a.Clone()
+		fo := FastOr(*res, *b)
+		require.Equal(t, sorted(or), sorted(fo.ToArray()))
+
+		require.Equal(t, sorted(andNot), sorted(AndNot(a, b).ToArray()))
+		require.Equal(t, sorted(xor), sorted(Xor(a, b).ToArray()))
+
+		res = a.Clone()
+		res.Xor(b)
+		require.Equal(t, sorted(xor), sorted(res.ToArray()))
+
+		require.Equal(t, len(and), a.AndCardinality(b))
+		require.Equal(t, len(and) > 0, a.Intersects(b))
+		require.Equal(t, len(andNot) == 0, a.IsSubsetOf(b))
+		require.Equal(t, len(andNot) == 0, b.IsSupersetOf(a))
+		require.Equal(t, len(xor) == 0, a.Equals(b))
+		require.Equal(t, len(or), a.OrCardinality(b))
+		require.Equal(t, len(andNot), a.AndNotCardinality(b))
+		require.Equal(t, len(xor), a.XorCardinality(b))
+
+		// The inputs should not be modified.
+		require.Equal(t, len(ma), a.GetCardinality())
+		require.Equal(t, len(mb), b.GetCardinality())
+	}
+
+	small := func() *Bitmap {
+		bm := NewBitmap()
+		for i := 0; i < 1000; i++ {
+			bm.Set(uint64(rand.Int63n(1 << 18)))
+		}
+		return bm
+	}
+	dense := func() *Bitmap {
+		bm := NewBitmap()
+		for i := 0; i < 100000; i++ {
+			bm.Set(uint64(rand.Int63n(1 << 18)))
+		}
+		return bm
+	}
+
+	gens := []func() *Bitmap{
+		small,
+		dense,
+		func() *Bitmap { return clustered(100, 1<<18) },
+		func() *Bitmap { return runify(clustered(100, 1<<18)) },
+		func() *Bitmap { return runify(clustered(1000, 1<<18)) },
+		func() *Bitmap { return runify(small()) },
+	}
+	for _, ga := range gens {
+		for _, gb := range gens {
+			check(ga(), gb())
+		}
+	}
+}
+
+func TestRunOptimize(t *testing.T) {
+	containerTypes := func(bm *Bitmap) map[uint16]int {
+		types := make(map[uint16]int)
+		for i := 0; i < bm.keys.numKeys(); i++ {
+			types[bm.getContainer(bm.keys.val(i))[indexType]]++
+		}
+		return types
+	}
+
+	// Dense ranges should be converted to run containers.
+	a := NewBitmap()
+	for i := uint64(0); i < 1<<20; i++ {
+		if i%(1<<12) < 1<<11 {
+			a.Set(i)
+		}
+	}
+	before := a.ToArray()
+	sz := len(a.data)
+	a.RunOptimize()
+	require.Equal(t, before, a.ToArray())
+	require.Less(t, len(a.data), sz)
+	require.Equal(t, map[uint16]int{typeRun: 16}, containerTypes(a))
+
+	// Bitmap containers should shrink back to arrays after removals.
+	b := NewBitmap()
+	for i := uint64(0); i < 1<<16; i++ {
+		b.Set(i * 3)
+	}
+	for i := uint64(0); i < 1<<16; i++ {
+		if i%100 != 0 {
+			b.Remove(i * 3)
+		}
+	}
+	before = b.ToArray()
+	b.RunOptimize()
+	require.Equal(t, before, b.ToArray())
+	require.Equal(t, map[uint16]int{typeArray: 3}, containerTypes(b))
+
+	// Empty containers are dropped, and the bitmap is still usable.
+	b.RemoveRange(1<<16, 2<<16)
+	b.RunOptimize()
+	require.Equal(t, 2, b.keys.numKeys())
+	for i := uint64(0); i < 1<<18; i++ {
+		b.Set(i)
+	}
+	require.Equal(t, 1<<18, b.GetCardinality())
+	b.RunOptimize()
+	require.Equal(t, map[uint16]int{typeRun: 4}, containerTypes(b))
+
+	// Random sparse data should stay as arrays.
+	c := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		c.Set(uint64(rand.Int63n(1 << 30)))
+	}
+	before = c.ToArray()
+	c.RunOptimize()
+	require.Equal(t, before, c.ToArray())
+	require.Zero(t, containerTypes(c)[typeRun])
+}
+
+func TestCompact(t *testing.T) {
+	a := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		a.Set(uint64(rand.Int63n(1 << 30)))
+	}
+	a.AddRange(1<<31, 1<<31+1e5)
+	// Leave some empty containers behind.
+	for i := uint64(0); i < 100; i++ {
+		a.Set(1<<40 + i<<16)
+	}
+	a.RemoveRange(1<<40, 1<<41)
+
+	before := a.ToArray()
+	buf := a.ToCompactBuffer()
+	require.Less(t, len(buf), len(a.ToBuffer()))
+	require.Equal(t, before, a.ToArray())
+
+	b := FromBuffer(buf)
+	require.True(t, a.Equals(b))
+	require.NoError(t, validate(b.data))
+
+	sz := len(a.data)
+	a.Compact()
+	require.Equal(t, 2*len(a.data), len(buf))
+	require.Less(t, len(a.data), sz)
+	require.Equal(t, before, a.ToArray())
+	require.NoError(t, validate(a.data))
+
+	// Compacting again shouldn't change anything.
+	a.Compact()
+	require.Equal(t, buf, a.ToBuffer())
+
+	// The compacted bitmap should still be usable.
+	for i := uint64(0); i < 1e4; i++ {
+		a.Set(i << 20)
+		a.Set(1<<31 + 1e5 + i)
+	}
+	for i := uint64(0); i < 1e4; i++ {
+		require.True(t, a.Contains(i<<20))
+	}
+	require.NoError(t, validate(a.data))
+
+	require.Nil(t, NewBitmap().ToCompactBuffer())
+	c := NewBitmap()
+	c.Compact()
+	require.True(t, c.IsEmpty())
+	c.Set(10)
+	require.Equal(t, []uint64{10}, c.ToArray())
+}
+
+func TestFromSortedListWithRuns(t *testing.T) {
+	var arr []uint64
+	for i := uint64(0); i < 1e6; i++ {
+		if i%1000 < 700 {
+			arr = append(arr, i)
+		}
+	}
+	r := FromSortedListWithRuns(arr)
+	require.Equal(t, arr, r.ToArray())
+	require.Less(t, len(r.data), len(FromSortedList(arr).data))
+	for i := 0; i < r.keys.numKeys(); i++ {
+		require.Equal(t, typeRun, r.getContainer(r.keys.val(i))[indexType])
+	}
+
+	r.Set(uint64(1e6))
+	require.True(t, r.Contains(uint64(1e6)))
+}
+
+func TestXor(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+
+	N := int(1e6)
+	for i := 0; i < N; i++ {
+		if i%2 == 0 {
+			a.Set(uint64(i))
+		}
+		if i%3 == 0 {
+			b.Set(uint64(i))
+		}
+	}
+	// Elements divisible by 2 or 3, but not by 6.
+	var expected []uint64
+	for i := 0; i < N; i++ {
+		if (i%2 == 0) != (i%3 == 0) {
+			expected = append(expected, uint64(i))
+		}
+	}
+	require.Equal(t, expected, Xor(a, b).ToArray())
+	require.Equal(t, expected, Xor(b, a).ToArray())
+	require.Equal(t, 0, Xor(a, a).GetCardinality())
+
+	a.Xor(b)
+	require.Equal(t, expected, a.ToArray())
+
+	// Xor of disjoint bitmaps is the same as their union.
+	c := NewBitmap()
+	d := NewBitmap()
+	c.SetMany([]uint64{1, 2, 3})
+	d.SetMany([]uint64{1 << 20, 1 << 40})
+	require.Equal(t, []uint64{1, 2, 3, 1 << 20, 1 << 40}, Xor(c, d).ToArray())
+	c.Xor(d)
+	require.Equal(t, []uint64{1, 2, 3, 1 << 20, 1 << 40}, c.ToArray())
+}
+
+func TestXorFullArray(t *testing.T) {
+	// Two disjoint arrays of 2048 values each, whose Xor has exactly 4096 values.
+	var av, bv []uint64
+	for i := uint64(0); i < 4096; i += 2 {
+		av = append(av, i)
+		bv = append(bv, i+1)
+	}
+	a, b := FromSortedList(av), FromSortedList(bv)
+
+	for _, res := range []*Bitmap{Xor(a, b), Xor(b, a)} {
+		require.Equal(t, 4096, res.GetCardinality())
+		require.NoError(t, validate(res.data))
+
+		// Grow the container.
+		res.Set(5000)
+		res.Set(5002)
+		require.Equal(t, 4098, res.GetCardinality())
+		require.True(t, res.Contains(5002))
+		require.NoError(t, validate(res.data))
+	}
+}
+
+func TestAndNotFunc(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	for i := 0; i < 10000; i++ {
+		a.Set(uint64(i))
+		if i < 7000 {
+			b.Set(uint64(i))
+		}
+	}
+	res := AndNot(a, b)
+	require.Equal(t, 3000, res.GetCardinality())
+	require.Equal(t, uint64(7000), res.Minimum())
+	require.Equal(t, 10000, a.GetCardinality())
+	require.Equal(t, 7000, b.GetCardinality())
+
+	require.Equal(t, 0, AndNot(b, a).GetCardinality())
+}
+
+func TestAndNotArrayBitmap(t *testing.T) {
+	// An array container minus a bitmap container.
+	a := NewBitmap()
+	for i := uint64(0); i < 100; i++ {
+		a.Set(i * 3)
+	}
+	b := NewBitmap()
+	for i := uint64(0); i < 10000; i += 2 {
+		b.Set(i)
+	}
+
+	res := AndNot(a, b)
+	require.Equal(t, 50, res.GetCardinality())
+	require.NoError(t, validate(res.data))
+	_, err := FromBufferSafe(res.ToBufferWithCopy())
+	require.NoError(t, err)
+
+	a.AndNot(b)
+	require.True(t, a.Equals(res))
+	require.NoError(t, validate(a.data))
+
+	// The result can be modified.
+	res.Set(1)
+	require.Equal(t, 51, res.GetCardinality())
+}
+
+func TestCardinalityOps(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	N := int(1e6)
+	for i := 0; i < N; i++ {
+		if i%2 == 0 {
+			a.Set(uint64(i))
+		}
+		if i%3 == 0 {
+			b.Set(uint64(i))
+		}
+	}
+	and := (N + 5) / 6
+	require.Equal(t, and, a.AndCardinality(b))
+	require.Equal(t, N/2+(N+2)/3-and, a.OrCardinality(b))
+	require.Equal(t, N/2-and, a.AndNotCardinality(b))
+	require.Equal(t, N/2+(N+2)/3-2*and, a.XorCardinality(b))
+
+	require.Equal(t, 0, a.AndCardinality(nil))
+	require.Equal(t, N/2, a.OrCardinality(nil))
+	require.Equal(t, N/2, a.AndNotCardinality(nil))
+	require.Equal(t, N/2, a.XorCardinality(nil))
+
+	allocs := testing.AllocsPerRun(10, func() {
+		a.AndCardinality(b)
+	})
+	require.Zero(t, allocs)
+}
+
+func TestIntersects(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	require.False(t, a.Intersects(b))
+	require.False(t, a.Intersects(nil))
+
+	for i := 0; i < 100000; i++ {
+		a.Set(uint64(2 * i))
+		b.Set(uint64(2*i + 1))
+	}
+	require.False(t, a.Intersects(b))
+	require.False(t, b.Intersects(a))
+
+	b.Set(1 << 40)
+	require.False(t, a.Intersects(b))
+	a.Set(1 << 40)
+	require.True(t, a.Intersects(b))
+	require.True(t, b.Intersects(a))
+
+	// Read only bitmaps.
+	ra := FromBuffer(a.ToBuffer())
+	rb := FromBuffer(b.ToBuffer())
+	require.True(t, ra.Intersects(rb))
+	b.Remove(1 << 40)
+	require.False(t, ra.Intersects(FromBuffer(b.ToBuffer())))
+}
+
+func TestEquals(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	require.True(t, a.Equals(b))
+	require.True(t, a.Equals(nil))
+	require.True(t, a.IsSubsetOf(b))
+
+	for i := uint64(0); i < 1e5; i++ {
+		a.Set(i)
+	}
+	for i := uint64(1e5); i > 0; i-- {
+		b.Set(i - 1)
+	}
+	b.Set(1 << 20)
+	b.Remove(1 << 20)
+	// The buffers differ, but the bitmaps are equal.
+	require.NotEqual(t, a.ToBuffer(), b.ToBuffer())
+	require.True(t, a.Equals(b))
+	require.True(t, b.Equals(a))
+	require.True(t, a.Equals(runify(b)))
+	require.True(t, a.IsSubsetOf(b))
+	require.True(t, a.IsSupersetOf(b))
+
+	b.Remove(500)
+	require.False(t, a.Equals(b))
+	require.False(t, a.IsSubsetOf(b))
+	require.True(t, a.IsSupersetOf(b))
+	require.True(t, b.IsSubsetOf(a))
+	require.True(t, runify(b).IsSubsetOf(a))
+	require.False(t, a.IsSubsetOf(nil))
+
+	b.Set(500)
+	b.Set(1 << 30)
+	require.False(t, a.Equals(b))
+	require.True(t, a.IsSubsetOf(b))
+	require.False(t, b.IsSubsetOf(a))
+}
+
+func TestAddRange(t *testing.T) {
+	check := func(bm *Bitmap, lo, hi uint64) {
+		expected := bm.Clone()
+		for x := lo; x < hi; x++ {
+			expected.Set(x)
+		}
+		bm.AddRange(lo, hi)
+		require.Equal(t, expected.GetCardinality(), bm.GetCardinality())
+		require.True(t, expected.Equals(bm))
+	}
+
+	a := NewBitmap()
+	check(a, 0, 0)
+	check(a, 10, 20)
+	check(a, 15, 30)
+	check(a, 1<<16-5, 1<<16+5)
+	check(a, 100, 1<<20+100)
+	check(a, 1<<40, 1<<40+1)
+	check(a, math.MaxUint64-1000, math.MaxUint64)
+
+	// Add ranges to array, bitmap and run containers.
+	for _, b := range []*Bitmap{
+		clustered(100, 1<<20),
+		runify(clustered(100, 1<<20)),
+		FromSortedList([]uint64{1, 3, 5, 7, 1 << 17, 1<<17 + 2}),
+	} {
+		for i := 0; i < 10; i++ {
+			lo := uint64(rand.Int63n(1 << 20))
+			check(b, lo, lo+uint64(rand.Int63n(1<<17)))
+		}
+		for i := 0; i < 100; i++ {
+			lo := uint64(rand.Int63n(1 << 20))
+			check(b, lo, lo+uint64(rand.Int63n(10)))
+		}
+	}
+
+	// The bitmap should still be modifiable.
+	a.Remove(1 << 19)
+	require.False(t, a.Contains(1<<19))
+	a.Set(1 << 19)
+	require.True(t, a.Contains(1<<19))
+}
+
+func TestFromRange(t *testing.T) {
+	r := FromRange(10, 10)
+	require.True(t, r.IsEmpty())
+
+	n := uint64(1e7)
+	r = FromRange(1, n)
+	require.Equal(t, int(n-1), r.GetCardinality())
+	require.Equal(t, uint64(1), r.Minimum())
+	require.Equal(t, n-1, r.Maximum())
+	for i := uint64(0); i < 1000; i++ {
+		x := uint64(rand.Int63n(int64(n)))
+		require.Equal(t, x >= 1, r.Contains(x))
+	}
+
+	var cnt uint64
+	itr := r.NewIterator()
+	for x, ok := itr.Next(); ok; x, ok = itr.Next() {
+		cnt++
+		require.Equal(t, cnt, x)
+	}
+	require.Equal(t, n-1, cnt)
+
+	r = FromRange(1<<32, 1<<32+(1<<18))
+	require.Equal(t, 1<<18, r.GetCardinality())
+	require.Equal(t, uint64(1<<32), r.Minimum())
+}
+
+func TestFlip(t *testing.T) {
+	check := func(bm *Bitmap, lo, hi uint64) {
+		expected := bm.Clone()
+		for x := lo; x < hi; x++ {
+			if !expected.Remove(x) {
+				expected.Set(x)
+			}
+		}
+		res := Flip(bm, lo, hi)
+		require.True(t, expected.Equals(res))
+
+		before := bm.GetCardinality()
+		bm.Flip(lo, hi)
+		require.True(t, expected.Equals(bm))
+		require.Equal(t, expected.GetCardinality(), bm.GetCardinality())
+
+		// Flipping again should give back the original bitmap.
+		res.Flip(lo, hi)
+		require.Equal(t, before, res.GetCardinality())
+	}
+
+	a := NewBitmap()
+	check(a, 0, 0)
+	check(a, 10, 20)
+	check(a, 15, 30)
+	check(a, 1<<16-5, 1<<16+5)
+	check(a, 100, 1<<20+100)
+	check(a, 0, 1<<20+200)
+
+	for _, b := range []*Bitmap{
+		clustered(100, 1<<20),
+		runify(clustered(100, 1<<20)),
+		FromSortedList([]uint64{1, 3, 5, 7, 1 << 17, 1<<17 + 2}),
+	} {
+		for i := 0; i < 10; i++ {
+			lo := uint64(rand.Int63n(1 << 20))
+			check(b, lo, lo+uint64(rand.Int63n(1<<17)))
+		}
+		for i := 0; i < 100; i++ {
+			lo := uint64(rand.Int63n(1 << 20))
+			check(b, lo, lo+uint64(rand.Int63n(10)))
+		}
+	}
+
+	// Flip the whole range to get the complement.
+	b := FromSortedList([]uint64{2, 4, 6})
+	require.Equal(t, []uint64{0, 1, 3, 5, 7}, Flip(b, 0, 8).ToArray())
+	require.Equal(t, []uint64{2, 4, 6}, b.ToArray())
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The compressed format is meant for shipping bitmaps over the network or storing them, where size
+// matters more than reading them in place. Every container is compressed on its own, so that the
+// containers of a key range can be decoded without decompressing the whole bitmap. It is laid out
+// as:
+// [0:8]  header: compressedMagic, followed by the format version and 3 zero bytes.
+// [8:16] the number of containers.
+// The directory: an entry of compressedEntrySize bytes for every non-empty container, sorted by
+// key. An entry holds the key and the offset of the compressed container in the buffer as uint64s,
+// followed by the compressed and uncompressed lengths of the container as uint32s.
+// The compressed containers.
+//
+// A container is compressed in its native layout, including its header, with its uint16s in
+// little-endian byte order. All the other integers are in little-endian byte order too.
+
+const (
+	compressedVersion    = 1
+	compressedHeaderSize = 16
+	compressedEntrySize  = 24
+)
+
+var compressedMagic = []byte("SRCZ")
+
+// Compressor compresses the containers of a bitmap for ToCompressedBuffer. Buffers must be
+// decompressed with the same Compressor they were compressed with. Implementations must be safe
+// for concurrent use.
+type Compressor interface {
+	// Compress appends the compressed src to dst, and returns the resulting slice.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress decompresses src into dst. dst has the size of the uncompressed data, and it is
+	// an error if src doesn't decompress to exactly that size.
+	Decompress(dst, src []byte) error
+}
+
+// DefaultCompressor is the Compressor used if nil is passed. It uses DEFLATE with the default
+// compression level.
+var DefaultCompressor Compressor = &flateCompressor{level: flate.DefaultCompression}
+
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// NewFlateCompressor returns a Compressor using DEFLATE (compress/flate) with the given
+// compression level.
+func NewFlateCompressor(level int) (Compressor, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, errors.Errorf("invalid flate compression level: %d", level)
+	}
+	return &flateCompressor{level: level}, nil
+}
+
+func (fc *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, _ := fc.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, fc.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer fc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fc *flateCompressor) Decompress(dst, src []byte) error {
+	r, _ := fc.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return err
+	}
+	defer fc.readers.Put(r)
+
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return err
+	}
+	var extra [1]byte
+	if n, err := r.Read(extra[:]); n > 0 || err != io.EOF {
+		return errors.Errorf("compressed data exceeds %d bytes", len(dst))
+	}
+	return nil
+}
+
+type compressedEntry struct {
+	key    uint64
+	offset uint64
+	clen   uint32
+	ulen   uint32
+}
+
+// ToCompressedBuffer returns the bitmap serialized in the compressed format, using the given
+// Compressor, or DefaultCompressor if it is nil. Unlike ToBuffer, the buffer can't be read in
+// place, and has to be decoded using FromCompressedBuffer or FromCompressedBufferRange.
+func (ra *Bitmap) ToCompressedBuffer(c Compressor) ([]byte, error) {
+	if c == nil {
+		c = DefaultCompressor
+	}
+	conts := ra.nonEmptyContainers()
+
+	hdr := make([]byte, 0, compressedHeaderSize+compressedEntrySize*len(conts))
+	hdr = append(hdr, compressedMagic...)
+	hdr = append(hdr, compressedVersion, 0, 0, 0)
+	hdr = appendUint64(hdr, uint64(len(conts)))
+
+	var body, raw []byte
+	offset := uint64(cap(hdr))
+	for i, kc := range conts {
+		cont := compactContainer(kc.c)
+		raw = raw[:0]
+		for _, x := range cont {
+			raw = appendUint16(raw, x)
+		}
+		var err error
+		n := len(body)
+		if body, err = c.Compress(body, raw); err != nil {
+			return nil, errors.Wrapf(err, "while compressing container %d", i)
+		}
+		hdr = appendUint64(hdr, kc.key)
+		hdr = appendUint64(hdr, offset+uint64(n))
+		hdr = appendUint32(hdr, uint32(len(body)-n))
+		hdr = appendUint32(hdr, uint32(len(raw)))
+	}
+	return append(hdr, body...), nil
+}
+
+// FromCompressedBuffer decodes a bitmap written by ToCompressedBuffer, using the given Compressor,
+// or DefaultCompressor if it is nil. The buffer is validated, and an error is returned if it is
+// corrupt.
+func FromCompressedBuffer(buf []byte, c Compressor) (*Bitmap, error) {
+	return fromCompressedBuffer(buf, c, 0, math.MaxUint64)
+}
+
+// FromCompressedBufferRange decodes the values in [lo, hi) of a bitmap written by
+// ToCompressedBuffer. Only the containers overlapping with the range are decompressed.
+func FromCompressedBufferRange(buf []byte, c Compressor, lo, hi uint64) (*Bitmap, error) {
+	if lo >= hi {
+		if _, err := readCompressedDirectory(buf); err != nil {
+			return nil, err
+		}
+		return NewBitmap(), nil
+	}
+	return fromCompressedBuffer(buf, c, lo, hi-1)
+}
+
+// fromCompressedBuffer decodes the values in [lo, last] of a compressed bitmap.
+func fromCompressedBuffer(buf []byte, c Compressor, lo, last uint64) (*Bitmap, error) {
+	if c == nil {
+		c = DefaultCompressor
+	}
+	entries, err := readCompressedDirectory(buf)
+	if err != nil {
+		return nil, err
+	}
+	st := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= lo&mask
+	})
+
+	var conts []keyedContainer
+	for i := st; i < len(entries) && entries[i].key <= last; i++ {
+		e := entries[i]
+		cont, err := decompressContainer(c, buf, e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while decoding container with key %#x", e.key)
+		}
+		// Trim the containers at the edges of the range.
+		if e.key == lo&mask && uint16(lo) > 0 {
+			removeRangeContainer(cont, 0, uint16(lo)-1)
+		}
+		if e.key == last&mask && uint16(last) < math.MaxUint16 {
+			removeRangeContainer(cont, uint16(last)+1, math.MaxUint16)
+		}
+		if getCardinality(cont) == 0 {
+			continue
+		}
+		conts = append(conts, keyedContainer{key: e.key, c: cont})
+	}
+	return fromContainers(conts), nil
+}
+
+func readCompressedDirectory(buf []byte) ([]compressedEntry, error) {
+	if len(buf) < compressedHeaderSize {
+		return nil, errors.Errorf("compressed buffer of %d bytes is too small", len(buf))
+	}
+	if !bytes.Equal(buf[:4], compressedMagic) {
+		return nil, errors.Errorf("invalid compressed bitmap magic")
+	}
+	if buf[4] == 0 || buf[4] > compressedVersion {
+		return nil, errors.Errorf("unsupported compressed bitmap version: %d", buf[4])
+	}
+	num := binary.LittleEndian.Uint64(buf[8:16])
+	if num > uint64(len(buf)-compressedHeaderSize)/compressedEntrySize {
+		return nil, errors.Errorf("directory of %d containers exceeds buffer of %d bytes",
+			num, len(buf))
+	}
+
+	dirEnd := uint64(compressedHeaderSize + compressedEntrySize*num)
+	entries := make([]compressedEntry, num)
+	for i := range entries {
+		b := buf[compressedHeaderSize+compressedEntrySize*i:]
+		e := compressedEntry{
+			key:    binary.LittleEndian.Uint64(b[0:8]),
+			offset: binary.LittleEndian.Uint64(b[8:16]),
+			clen:   binary.LittleEndian.Uint32(b[16:20]),
+			ulen:   binary.LittleEndian.Uint32(b[20:24]),
+		}
+		if e.key&^mask != 0 {
+			return nil, errors.Errorf("invalid key %#x at entry %d", e.key, i)
+		}
+		if i > 0 && e.key <= entries[i-1].key {
+			return nil, errors.Errorf("directory is not sorted at entry %d", i)
+		}
+		if e.offset < dirEnd || e.offset > uint64(len(buf)) ||
+			uint64(e.clen) > uint64(len(buf))-e.offset {
+			return nil, errors.Errorf("invalid entry %d: offset %d, length %d", i, e.offset, e.clen)
+		}
+		if e.ulen%2 != 0 || e.ulen/2 <= uint32(startIdx) || e.ulen/2 > maxContainerSize {
+			return nil, errors.Errorf("invalid container size %d at entry %d", e.ulen, i)
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// decompressContainer decompresses and validates the container for the given entry.
+func decompressContainer(c Compressor, buf []byte, e compressedEntry) ([]uint16, error) {
+	raw := make([]byte, e.ulen)
+	if err := c.Decompress(raw, buf[e.offset:e.offset+uint64(e.clen)]); err != nil {
+		return nil, err
+	}
+	cont := make([]uint16, len(raw)/2)
+	for i := range cont {
+		cont[i] = binary.LittleEndian.Uint16(raw[2*i:])
+	}
+	if int(cont[indexSize]) != len(cont) {
+		return nil, errors.Errorf("container size %d doesn't match %d", cont[indexSize], len(cont))
+	}
+	if err := validateContainer(cont); err != nil {
+		return nil, err
+	}
+	// Ensure there's a free slot in the container.
+	return compactContainer(cont), nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedBuffer(t *testing.T) {
+	fast, err := NewFlateCompressor(flate.BestSpeed)
+	require.NoError(t, err)
+	_, err = NewFlateCompressor(10)
+	require.Error(t, err)
+
+	// Sparse values in array containers, dense ones in bitmap containers, ranges in run
+	// containers, and an empty container.
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 40)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	dense.Set(1 << 30)
+	dense.Remove(1 << 30)
+	ranges := FromRange(0, 1<<16)
+	for i := uint64(1); i < 100; i++ {
+		ranges.AddRange(i<<24, i<<24+i*100)
+	}
+	ranges.Or(*sparse)
+
+	for i, a := range []*Bitmap{NewBitmap(), sparse, dense, ranges} {
+		for _, c := range []Compressor{nil, fast} {
+			buf, err := a.ToCompressedBuffer(c)
+			require.NoError(t, err)
+			b, err := FromCompressedBuffer(buf, c)
+			require.NoError(t, err)
+			require.True(t, a.Equals(b), "bitmap %d", i)
+			require.NoError(t, validate(b.data))
+
+			// The decoded bitmap can be modified.
+			b.Set(1 << 50)
+			require.Equal(t, a.GetCardinality()+1, b.GetCardinality())
+		}
+	}
+
+	// Dense bitmaps compress well.
+	a := NewBitmap()
+	for i := uint64(0); i < 1<<20; i += 2 {
+		a.Set(i)
+	}
+	buf, err := a.ToCompressedBuffer(nil)
+	require.NoError(t, err)
+	require.Less(t, len(buf), len(a.ToBuffer())/10)
+
+	a.Set(math.MaxUint64)
+	buf, err = a.ToCompressedBuffer(nil)
+	require.NoError(t, err)
+	b, err := FromCompressedBuffer(buf, nil)
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+}
+
+func TestCompressedBufferRange(t *testing.T) {
+	a := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		a.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	a.AddRange(1<<24, 1<<24+1e5)
+	buf, err := a.ToCompressedBuffer(nil)
+	require.NoError(t, err)
+
+	check := func(lo, hi uint64) {
+		b, err := FromCompressedBufferRange(buf, nil, lo, hi)
+		require.NoError(t, err)
+		exp := a.Clone()
+		exp.RemoveRange(0, lo)
+		exp.RemoveRange(hi, math.MaxUint64)
+		require.True(t, exp.Equals(b), "range [%d, %d)", lo, hi)
+		require.NoError(t, validate(b.data))
+	}
+	check(0, 1<<16)
+	check(1<<16, 1<<17)
+	check(100, 1000)
+	check(1<<20+5, 1<<24+100)
+	check(1<<24+10, 1<<24+11)
+	check(1<<30, math.MaxUint64)
+	for i := 0; i < 20; i++ {
+		lo := uint64(rand.Int63n(1 << 25))
+		check(lo, lo+uint64(rand.Int63n(1<<20)))
+	}
+
+	b, err := FromCompressedBufferRange(buf, nil, 10, 10)
+	require.NoError(t, err)
+	require.True(t, b.IsEmpty())
+}
+
+func TestCompressedBufferInvalid(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	buf, err := a.ToCompressedBuffer(nil)
+	require.NoError(t, err)
+
+	_, err = FromCompressedBuffer(nil, nil)
+	require.Error(t, err)
+	_, err = FromCompressedBuffer(a.ToBuffer(), nil)
+	require.Error(t, err)
+	for _, sz := range []int{10, compressedHeaderSize + 10, len(buf) / 2, len(buf) - 1} {
+		_, err = FromCompressedBuffer(buf[:sz], nil)
+		require.Error(t, err, "size %d", sz)
+	}
+
+	corrupt := func(fn func(b []byte)) {
+		cp := append([]byte{}, buf...)
+		fn(cp)
+		_, err := FromCompressedBuffer(cp, nil)
+		require.Error(t, err)
+	}
+	// The number of containers, the key and the uncompressed length of the first container.
+	corrupt(func(b []byte) { binary.LittleEndian.PutUint64(b[8:], 1<<40) })
+	corrupt(func(b []byte) { b[compressedHeaderSize]++ })
+	corrupt(func(b []byte) { b[compressedHeaderSize+20] += 2 })
+	// The compressed data.
+	corrupt(func(b []byte) {
+		off := binary.LittleEndian.Uint64(b[compressedHeaderSize+8:])
+		for i := 0; i < 8; i++ {
+			b[int(off)+i] ^= 0xFF
+		}
+	})
+}
@@ -28,10 +28,13 @@ import (
 // The container size cannot exceed the vicinity of 8KB. At 8KB, we switch from packed arrays to
 // bitmaps. We can fit the entire uint16 worth of bitmaps in 8KB (2^16 / 8 = 8
 // KB).
+// Run containers store intervals of consecutive integers. They are also capped at 8KB, beyond
+// which they get converted to bitmaps.
 
 const (
 	typeArray  uint16 = 0x00
 	typeBitmap uint16 = 0x01
+	typeRun    uint16 = 0x02
 
 	// Container header.
 	indexSize        int = 0
@@ -84,6 +87,8 @@ func zeroOutContainer(c []uint16) {
 		array(c).zeroOut()
 	case typeBitmap:
 		bitmap(c).zeroOut()
+	case typeRun:
+		run(c).zeroOut()
 	}
 }
 
@@ -93,6 +98,8 @@ func removeRangeContainer(c []uint16, lo, hi uint16) {
 		array(c).removeRange(lo, hi)
 	case typeBitmap:
 		bitmap(c).removeRange(lo, hi)
+	case typeRun:
+		run(c).removeRange(lo, hi)
 	}
 }
 
@@ -269,6 +276,25 @@ func (c array) orArray(other array, buf []uint16, runMode int) []uint16 {
 	return out
 }
 
+func (c array) xorArray(other array) []uint16 {
+	vals := make([]uint16, getCardinality(c)+getCardinality(other))
+	num := exclusiveUnion2by2(c.all(), other.all(), vals)
+	// arrayContainerFrom returns a bitmap container if the values don't fit in an array container.
+	return arrayContainerFrom(vals[:num])
+}
+
+func (c array) xorBitmap(other bitmap, buf []uint16) []uint16 {
+	copy(buf, other)
+	// add and remove keep the cardinality updated.
+	b := bitmap(buf)
+	for _, x := range c.all() {
+		if !b.add(x) {
+			b.remove(x)
+		}
+	}
+	return b
+}
+
 var tmp = make([]uint16, 8192)
 
 func (c array) andBitmap(other bitmap) []uint16 {
@@ -290,15 +316,21 @@ func (c array) andBitmap(other bitmap) []uint16 {
 
 // TODO: Write an optmized version of this function.
 func (c array) andNotBitmap(other bitmap, buf []uint16) []uint16 {
-	assert(len(buf) == maxContainerSize)
-	res := array(buf)
-	Memclr(res)
-	res[indexSize] = 4
+	out := make([]uint16, int(startIdx)+getCardinality(c)+1)
+	out[indexType] = typeArray
+
+	pos := int(startIdx)
 	for _, e := range c.all() {
 		if !other.has(e) {
-			res.add(e)
+			out[pos] = e
+			pos++
 		}
 	}
+
+	// Ensure we have at least one empty slot at the end.
+	res := out[:pos+1]
+	res[indexSize] = uint16(len(res))
+	setCardinality(res, pos-int(startIdx))
 	return res
 }
 
@@ -350,6 +382,39 @@ func (c array) toBitmapContainer(buf []uint16) []uint16 {
 	return b
 }
 
+func (c array) andNotRun(other run) []uint16 {
+	out := make([]uint16, int(startIdx)+getCardinality(c)+1)
+	out[indexType] = typeArray
+
+	pos := int(startIdx)
+	for _, x := range c.all() {
+		if !other.has(x) {
+			out[pos] = x
+			pos++
+		}
+	}
+
+	// Ensure we have at least one empty slot at the end.
+	res := out[:pos+1]
+	res[indexSize] = uint16(len(res))
+	setCardinality(res, pos-int(startIdx))
+	return res
+}
+
+// toRuns returns the elements of the array as sorted (start, last) pairs.
+func (c array) toRuns() []uint16 {
+	return toRuns(c.all())
+}
+
+// numRuns returns the number of runs needed to store the elements of the array.
+func (c array) numRuns() int {
+	return numRuns(c.all())
+}
+
+func (c array) toRunContainer() []uint16 {
+	return runContainerFrom(c.toRuns())
+}
+
 func (c array) String() string {
 	var b strings.Builder
 	b.WriteString(fmt.Sprintf("Size: %d\n", c[0]))
@@ -658,6 +723,221 @@ func (b bitmap) cardinality() int {
 	return num
 }
 
+func (b bitmap) andNotRun(other run) []uint16 {
+	pairs := other.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		b.removeRange(pairs[i], pairs[i+1])
+	}
+	return b
+}
+
+func (b bitmap) orRun(other run, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b)
+	}
+
+	pairs := other.runs()
+	if num := getCardinality(b); num == maxCardinality {
+		// do nothing. This bitmap is already full.
+
+	} else if runMode&runLazy > 0 || num == invalidCardinality {
+		for i := 0; i < len(pairs); i += 2 {
+			bitmap(buf).setRange(pairs[i], pairs[i+1])
+		}
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		num := getCardinality(buf)
+		for i := 0; i < len(pairs); i += 2 {
+			num += bitmap(buf).setRange(pairs[i], pairs[i+1])
+		}
+		setCardinality(buf, num)
+	}
+
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
+
+func (b bitmap) andArrayCardinality(other array) int {
+	var num int
+	for _, x := range other.all() {
+		num += int(b.bitValue(x))
+	}
+	return num
+}
+
+func (b bitmap) andBitmapCardinality(other bitmap) int {
+	var num int
+	for i := int(startIdx); i < len(b); i++ {
+		num += bits.OnesCount16(b[i] & other[i])
+	}
+	return num
+}
+
+func (b bitmap) andRunCardinality(other run) int {
+	var num int
+	pairs := other.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		lo, hi := pairs[i], pairs[i+1]
+		for j := int(lo >> 4); j <= int(hi>>4); j++ {
+			num += bits.OnesCount16(b[int(startIdx)+j] & rangeMask(j, lo, hi))
+		}
+	}
+	return num
+}
+
+func (b bitmap) intersectsArray(other array) bool {
+	for _, x := range other.all() {
+		if b.has(x) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b bitmap) intersectsBitmap(other bitmap) bool {
+	for i := int(startIdx); i < len(b); i++ {
+		if b[i]&other[i] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b bitmap) intersectsRun(other run) bool {
+	pairs := other.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		lo, hi := pairs[i], pairs[i+1]
+		for j := int(lo >> 4); j <= int(hi>>4); j++ {
+			if b[int(startIdx)+j]&rangeMask(j, lo, hi) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b bitmap) xorBitmap(other bitmap) []uint16 {
+	out := make([]uint16, maxContainerSize)
+	out[indexSize] = maxContainerSize
+	out[indexType] = typeBitmap
+	var num int
+	for i := int(startIdx); i < len(b); i++ {
+		out[i] = b[i] ^ other[i]
+		num += bits.OnesCount16(out[i])
+	}
+	setCardinality(out, num)
+	return out
+}
+
+func (b bitmap) xorRun(other run, buf []uint16) []uint16 {
+	copy(buf, b)
+	out := bitmap(buf)
+	num := getCardinality(out)
+	pairs := other.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		num += out.flipRange(pairs[i], pairs[i+1])
+	}
+	setCardinality(out, num)
+	return out
+}
+
+// rangeMask returns the mask of the bits in the ith uint16 of a bitmap container which lie in
+// [lo, hi].
+func rangeMask(i int, lo, hi uint16) uint16 {
+	m := uint16(0xFFFF)
+	if i == int(lo>>4) {
+		m &= 0xFFFF >> (lo & 0xF)
+	}
+	if i == int(hi>>4) {
+		m &= 0xFFFF << (15 - hi&0xF)
+	}
+	return m
+}
+
+// setRange sets all the bits in [lo, hi] and returns the number of bits which were not set before.
+// It does not update the cardinality of the container.
+func (b bitmap) setRange(lo, hi uint16) int {
+	var added int
+	for i := int(lo >> 4); i <= int(hi>>4); i++ {
+		m := rangeMask(i, lo, hi)
+		w := &b[int(startIdx)+i]
+		added += bits.OnesCount16(m &^ *w)
+		*w |= m
+	}
+	return added
+}
+
+// numRuns returns the number of runs needed to store the elements of the bitmap.
+func (b bitmap) numRuns() int {
+	var n int
+	var prev uint16
+	for _, w := range b[startIdx:] {
+		// Every set bit, whose preceding bit is not set, starts a run. The preceding bit of the
+		// first bit in a uint16 is the last bit of the previous uint16.
+		n += bits.OnesCount16(w &^ (w>>1 | prev<<15))
+		prev = w & 1
+	}
+	return n
+}
+
+func (b bitmap) toArrayContainer() []uint16 {
+	vals := b.all()
+	// Keep an empty slot at the end, so that adding an element using Set operation doesn't fail.
+	out := make([]uint16, int(startIdx)+len(vals)+1)
+	out[indexSize] = uint16(len(out))
+	out[indexType] = typeArray
+	copy(out[startIdx:], vals)
+	setCardinality(out, len(vals))
+	return out
+}
+
+// flipRange flips all the bits in [lo, hi] and returns the change in the number of set bits. It
+// does not update the cardinality of the container.
+func (b bitmap) flipRange(lo, hi uint16) int {
+	var delta int
+	for i := int(lo >> 4); i <= int(hi>>4); i++ {
+		m := rangeMask(i, lo, hi)
+		w := &b[int(startIdx)+i]
+		delta += bits.OnesCount16(m) - 2*bits.OnesCount16(*w&m)
+		*w ^= m
+	}
+	return delta
+}
+
+// toRuns returns the elements of the bitmap as sorted (start, last) pairs.
+func (b bitmap) toRuns() []uint16 {
+	var out []uint16
+	var inRun bool
+	var s int
+	for i, w := range b[startIdx:] {
+		if (w == 0 && !inRun) || (w == math.MaxUint16 && inRun) {
+			continue
+		}
+		for pos := 0; pos < 16; pos++ {
+			has := w&bitmapMask[pos] > 0
+			if has && !inRun {
+				s, inRun = 16*i+pos, true
+			} else if !has && inRun {
+				out = append(out, uint16(s), uint16(16*i+pos-1))
+				inRun = false
+			}
+		}
+	}
+	if inRun {
+		out = append(out, uint16(s), math.MaxUint16)
+	}
+	return out
+}
+
+func (b bitmap) toRunContainer() []uint16 {
+	return runContainerFrom(b.toRuns())
+}
+
 var zeroContainer = make([]uint16, maxContainerSize)
 
 func (b bitmap) zeroOut() {
@@ -665,6 +945,628 @@ func (b bitmap) zeroOut() {
 	copy(b[startIdx:], zeroContainer[startIdx:])
 }
 
+// run container stores the set values as sorted, non-overlapping intervals [start, last]. The
+// first uint16 after the header holds the number of runs, followed by the (start, last) pairs.
+// A run container always keeps space for one more run, so that add can be done in place.
+type run []uint16
+
+// maxRuns is the maximum number of runs a run container can hold, while still being smaller than
+// a bitmap container.
+const maxRuns = (maxContainerSize - int(startIdx) - 1) / 2
+
+// runOffset returns the index of the start of ith run in the container.
+func runOffset(i int) int { return int(startIdx) + 1 + 2*i }
+
+// runContainerSize returns the size of a run container which can hold n runs, plus space for
+// another one.
+func runContainerSize(n int) int { return runOffset(n + 1) }
+
+func (r run) numRuns() int             { return int(r[startIdx]) }
+func (r run) setNumRuns(n int)         { r[startIdx] = uint16(n) }
+func (r run) start(i int) uint16       { return r[runOffset(i)] }
+func (r run) last(i int) uint16        { return r[runOffset(i)+1] }
+func (r run) setStart(i int, x uint16) { r[runOffset(i)] = x }
+func (r run) setLast(i int, x uint16)  { r[runOffset(i)+1] = x }
+
+// runs returns the (start, last) pairs stored in the container.
+func (r run) runs() []uint16 {
+	return r[runOffset(0):runOffset(r.numRuns())]
+}
+
+// find returns the index of the first run whose last element is >= x. If there's no such run,
+// then the number of runs is returned.
+func (r run) find(x uint16) int {
+	lo, hi := 0, r.numRuns()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if r.last(mid) < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (r run) has(x uint16) bool {
+	i := r.find(x)
+	return i < r.numRuns() && r.start(i) <= x
+}
+
+// replaceRuns replaces the runs in [i, j) with the given pairs. The caller must ensure that the
+// container has enough space for the resulting runs.
+func (r run) replaceRuns(i, j int, pairs ...uint16) {
+	n := r.numRuns()
+	k := i + len(pairs)/2
+	assert(runOffset(n+k-j) <= len(r))
+	copy(r[runOffset(k):], r[runOffset(j):runOffset(n)])
+	copy(r[runOffset(i):], pairs)
+	r.setNumRuns(n + k - j)
+}
+
+func (r run) add(x uint16) bool {
+	n := r.numRuns()
+	i := r.find(x)
+	if i < n && r.start(i) <= x {
+		return false
+	}
+	// x lies between run i-1 and run i. Check if it extends either of them.
+	extendLeft := i > 0 && r.last(i-1)+1 == x
+	extendRight := i < n && x+1 == r.start(i)
+	switch {
+	case extendLeft && extendRight:
+		r.replaceRuns(i-1, i+1, r.start(i-1), r.last(i))
+	case extendLeft:
+		r.setLast(i-1, x)
+	case extendRight:
+		r.setStart(i, x)
+	default:
+		r.replaceRuns(i, i, x, x)
+	}
+	incrCardinality(r)
+	return true
+}
+
+func (r run) remove(x uint16) bool {
+	i := r.find(x)
+	if i == r.numRuns() || r.start(i) > x {
+		return false
+	}
+	s, l := r.start(i), r.last(i)
+	switch {
+	case s == l:
+		r.replaceRuns(i, i+1)
+	case x == s:
+		r.setStart(i, x+1)
+	case x == l:
+		r.setLast(i, x-1)
+	default:
+		// Split the run into two.
+		r.replaceRuns(i, i+1, s, x-1, x+1, l)
+	}
+	setCardinality(r, getCardinality(r)-1)
+	return true
+}
+
+// removeRange removes [lo, hi] from the container. It might split a run into two, so the caller
+// should check if the container is full afterwards.
+func (r run) removeRange(lo, hi uint16) {
+	if hi < lo {
+		panic(fmt.Sprintf("args must satisfy lo <= hi, got lo: %d, hi: %d\n", lo, hi))
+	}
+	n := r.numRuns()
+	i := r.find(lo)
+	if i == n || r.start(i) > hi {
+		return
+	}
+	// Runs [i, j) overlap with [lo, hi].
+	j := r.find(hi)
+	if j < n && r.start(j) <= hi {
+		j++
+	}
+
+	var removed int
+	for k := i; k < j; k++ {
+		s := max(int(r.start(k)), int(lo))
+		l := min(int(r.last(k)), int(hi))
+		removed += l - s + 1
+	}
+
+	var pairs []uint16
+	if r.start(i) < lo {
+		pairs = append(pairs, r.start(i), lo-1)
+	}
+	if r.last(j-1) > hi {
+		pairs = append(pairs, hi+1, r.last(j-1))
+	}
+	r.replaceRuns(i, j, pairs...)
+	setCardinality(r, getCardinality(r)-removed)
+}
+
+func (r run) zeroOut() {
+	r.setNumRuns(0)
+	setCardinality(r, 0)
+}
+
+// isFull returns true if there's no space to add another run in the container.
+func (r run) isFull() bool {
+	return runOffset(r.numRuns()+1) > len(r)
+}
+
+func (r run) rank(x uint16) int {
+	i := r.find(x)
+	if i == r.numRuns() || r.start(i) > x {
+		return -1
+	}
+	var rank int
+	for k := 0; k < i; k++ {
+		rank += int(r.last(k)-r.start(k)) + 1
+	}
+	return rank + int(x-r.start(i))
+}
+
+func (r run) selectAt(idx int) uint16 {
+	for k := 0; k < r.numRuns(); k++ {
+		sz := int(r.last(k)-r.start(k)) + 1
+		if idx < sz {
+			return r.start(k) + uint16(idx)
+		}
+		idx -= sz
+	}
+	panic("should not reach here")
+}
+
+func (r run) all() []uint16 {
+	res := make([]uint16, 0, getCardinality(r))
+	for k := 0; k < r.numRuns(); k++ {
+		for x := int(r.start(k)); x <= int(r.last(k)); x++ {
+			res = append(res, uint16(x))
+		}
+	}
+	return res
+}
+
+func (r run) minimum() uint16 {
+	if r.numRuns() == 0 {
+		return 0
+	}
+	return r.start(0)
+}
+
+func (r run) maximum() uint16 {
+	n := r.numRuns()
+	if n == 0 {
+		return 0
+	}
+	return r.last(n - 1)
+}
+
+func (r run) cardinality() int {
+	return runsCardinality(r.runs())
+}
+
+func (r run) toBitmapContainer(buf []uint16) []uint16 {
+	if len(buf) == 0 {
+		buf = make([]uint16, maxContainerSize)
+	} else {
+		assert(len(buf) == maxContainerSize)
+		assert(len(buf) == copy(buf, empty))
+	}
+
+	b := bitmap(buf)
+	b[indexSize] = maxContainerSize
+	b[indexType] = typeBitmap
+	pairs := r.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		b.setRange(pairs[i], pairs[i+1])
+	}
+	setCardinality(b, getCardinality(r))
+	return b
+}
+
+func (r run) toArrayContainer() []uint16 {
+	card := getCardinality(r)
+	// Keep an empty slot at the end, so that adding an element using Set operation doesn't fail.
+	out := make([]uint16, int(startIdx)+card+1)
+	out[indexSize] = uint16(len(out))
+	out[indexType] = typeArray
+	pos := int(startIdx)
+	for k := 0; k < r.numRuns(); k++ {
+		for x := int(r.start(k)); x <= int(r.last(k)); x++ {
+			out[pos] = uint16(x)
+			pos++
+		}
+	}
+	setCardinality(out, card)
+	return out
+}
+
+func (r run) andArray(other array) []uint16 {
+	out := make([]uint16, int(startIdx)+getCardinality(other)+2) // some extra space.
+	out[indexType] = typeArray
+
+	pos := int(startIdx)
+	var k int
+	n := r.numRuns()
+	for _, x := range other.all() {
+		for k < n && r.last(k) < x {
+			k++
+		}
+		if k == n {
+			break
+		}
+		if r.start(k) <= x {
+			out[pos] = x
+			pos++
+		}
+	}
+
+	// Ensure we have at least one empty slot at the end.
+	res := out[:pos+1]
+	res[indexSize] = uint16(len(res))
+	setCardinality(res, pos-int(startIdx))
+	return res
+}
+
+func (r run) andArrayCardinality(other array) int {
+	var num, k int
+	n := r.numRuns()
+	for _, x := range other.all() {
+		for k < n && r.last(k) < x {
+			k++
+		}
+		if k == n {
+			break
+		}
+		if r.start(k) <= x {
+			num++
+		}
+	}
+	return num
+}
+
+func (r run) intersectsArray(other array) bool {
+	var k int
+	n := r.numRuns()
+	for _, x := range other.all() {
+		for k < n && r.last(k) < x {
+			k++
+		}
+		if k == n {
+			return false
+		}
+		if r.start(k) <= x {
+			return true
+		}
+	}
+	return false
+}
+
+func (r run) andBitmap(other bitmap) []uint16 {
+	out := bitmap(make([]uint16, maxContainerSize))
+	out[indexSize] = maxContainerSize
+	out[indexType] = typeBitmap
+	pairs := r.runs()
+	for i := 0; i < len(pairs); i += 2 {
+		out.setRange(pairs[i], pairs[i+1])
+	}
+	var num int
+	for i := int(startIdx); i < len(out); i++ {
+		out[i] &= other[i]
+		num += bits.OnesCount16(out[i])
+	}
+	setCardinality(out, num)
+	return out
+}
+
+func (r run) andRun(other run) []uint16 {
+	return runContainerFrom(runsAnd(r.runs(), other.runs()))
+}
+
+func (r run) andNotArray(other array) []uint16 {
+	return runContainerFrom(runsAndNot(r.runs(), other.toRuns()))
+}
+
+func (r run) andNotBitmap(other bitmap, buf []uint16) []uint16 {
+	out := bitmap(r.toBitmapContainer(buf))
+	return out.andNotBitmap(other)
+}
+
+func (r run) andNotRun(other run) []uint16 {
+	return runContainerFrom(runsAndNot(r.runs(), other.runs()))
+}
+
+func (r run) orRun(other run) []uint16 {
+	return runContainerFrom(runsOr(r.runs(), other.runs()))
+}
+
+func (r run) xorArray(other array) []uint16 {
+	return runContainerFrom(runsXor(r.runs(), other.toRuns()))
+}
+
+func (r run) xorRun(other run) []uint16 {
+	return runContainerFrom(runsXor(r.runs(), other.runs()))
+}
+
+func (r run) String() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("Size: %d\n", r[0]))
+	for k := 0; k < r.numRuns(); k++ {
+		b.WriteString(fmt.Sprintf("%d: [%d, %d]\n", k, r.start(k), r.last(k)))
+	}
+	return b.String()
+}
+
+// compactContainer returns a copy of the container, without the unused space at its end. Array
+// and run containers keep space for one more element or run, so that they can be modified in place.
+func compactContainer(c []uint16) []uint16 {
+	var sz, used int
+	switch c[indexType] {
+	case typeArray:
+		used = int(startIdx) + getCardinality(c)
+		sz = used + 1
+	case typeBitmap:
+		used, sz = maxContainerSize, maxContainerSize
+	case typeRun:
+		used = runOffset(run(c).numRuns())
+		sz = runContainerSize(run(c).numRuns())
+	}
+	out := make([]uint16, sz)
+	copy(out, c[:used])
+	out[indexSize] = uint16(sz)
+	return out
+}
+
+// arrayContainerFrom creates a container out of the given sorted values. If the values can't fit
+// in an array container, a bitmap container is returned instead.
+func arrayContainerFrom(vals []uint16) []uint16 {
+	// Keep an empty slot at the end, so that adding an element using Set operation doesn't fail.
+	sz := int(startIdx) + len(vals) + 1
+	if sz >= maxContainerSize {
+		b := bitmap(make([]uint16, maxContainerSize))
+		b[indexSize] = maxContainerSize
+		b[indexType] = typeBitmap
+		for _, x := range vals {
+			b.add(x)
+		}
+		return b
+	}
+
+	out := make([]uint16, sz)
+	out[indexSize] = uint16(sz)
+	out[indexType] = typeArray
+	copy(out[startIdx:], vals)
+	setCardinality(out, len(vals))
+	return out
+}
+
+// runContainerFrom creates a container out of the given (start, last) pairs. If the runs can't fit
+// in a run container, a bitmap container is returned instead.
+func runContainerFrom(pairs []uint16) []uint16 {
+	n := len(pairs) / 2
+	if n > maxRuns-1 {
+		b := bitmap(make([]uint16, maxContainerSize))
+		b[indexSize] = maxContainerSize
+		b[indexType] = typeBitmap
+		for i := 0; i < len(pairs); i += 2 {
+			b.setRange(pairs[i], pairs[i+1])
+		}
+		setCardinality(b, runsCardinality(pairs))
+		return b
+	}
+
+	sz := runContainerSize(n)
+	r := run(make([]uint16, sz))
+	r[indexSize] = uint16(sz)
+	r[indexType] = typeRun
+	r.setNumRuns(n)
+	copy(r[runOffset(0):], pairs)
+	setCardinality(r, runsCardinality(pairs))
+	return r
+}
+
+// toRuns returns the given sorted values as (start, last) pairs.
+func toRuns(vals []uint16) []uint16 {
+	var out []uint16
+	for _, x := range vals {
+		if n := len(out); n > 0 && int(out[n-1])+1 == int(x) {
+			out[n-1] = x
+			continue
+		}
+		out = append(out, x, x)
+	}
+	return out
+}
+
+// numRuns returns the number of runs in the given sorted values.
+func numRuns(vals []uint16) int {
+	var n int
+	for i, x := range vals {
+		if i == 0 || int(vals[i-1])+1 != int(x) {
+			n++
+		}
+	}
+	return n
+}
+
+// optimizeContainer returns the given container in whichever of array, bitmap or run encoding
+// takes the least space. The returned container has no slack, except for the space needed to add
+// one more element.
+func optimizeContainer(c []uint16) []uint16 {
+	card := getCardinality(c)
+	var runs int
+	switch c[indexType] {
+	case typeArray:
+		runs = array(c).numRuns()
+	case typeBitmap:
+		runs = bitmap(c).numRuns()
+	case typeRun:
+		runs = run(c).numRuns()
+	}
+
+	arraySz := int(startIdx) + card + 1
+	runSz := runContainerSize(runs)
+	switch {
+	case runSz < arraySz && runSz < maxContainerSize:
+		switch c[indexType] {
+		case typeArray:
+			return array(c).toRunContainer()
+		case typeBitmap:
+			return bitmap(c).toRunContainer()
+		case typeRun:
+			return runContainerFrom(run(c).runs())
+		}
+	case arraySz < maxContainerSize:
+		switch c[indexType] {
+		case typeArray:
+			out := make([]uint16, arraySz)
+			copy(out, c[:int(startIdx)+card])
+			out[indexSize] = uint16(arraySz)
+			return out
+		case typeBitmap:
+			return bitmap(c).toArrayContainer()
+		case typeRun:
+			return run(c).toArrayContainer()
+		}
+	default:
+		switch c[indexType] {
+		case typeArray:
+			return array(c).toBitmapContainer(nil)
+		case typeBitmap:
+			out := make([]uint16, maxContainerSize)
+			copy(out, c)
+			return out
+		case typeRun:
+			return run(c).toBitmapContainer(nil)
+		}
+	}
+	panic("optimizeContainer: We should not reach here")
+}
+
+// runsCardinality returns the number of elements covered by the given (start, last) pairs.
+func runsCardinality(pairs []uint16) int {
+	var num int
+	for i := 0; i < len(pairs); i += 2 {
+		num += int(pairs[i+1]-pairs[i]) + 1
+	}
+	return num
+}
+
+// runsOr returns the union of two sorted lists of (start, last) pairs.
+func runsOr(a, b []uint16) []uint16 {
+	out := make([]uint16, 0, len(a)+len(b))
+	appendRun := func(s, l uint16) {
+		if n := len(out); n > 0 && int(s) <= int(out[n-1])+1 {
+			out[n-1] = max16(out[n-1], l)
+			return
+		}
+		out = append(out, s, l)
+	}
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if a[i] <= b[j] {
+			appendRun(a[i], a[i+1])
+			i += 2
+		} else {
+			appendRun(b[j], b[j+1])
+			j += 2
+		}
+	}
+	for ; i < len(a); i += 2 {
+		appendRun(a[i], a[i+1])
+	}
+	for ; j < len(b); j += 2 {
+		appendRun(b[j], b[j+1])
+	}
+	return out
+}
+
+// runsAnd returns the intersection of two sorted lists of (start, last) pairs.
+func runsAnd(a, b []uint16) []uint16 {
+	var out []uint16
+	var i, j int
+	for i < len(a) && j < len(b) {
+		s := max16(a[i], b[j])
+		l := min16(a[i+1], b[j+1])
+		if s <= l {
+			out = append(out, s, l)
+		}
+		// Advance the run which ends first.
+		if a[i+1] < b[j+1] {
+			i += 2
+		} else {
+			j += 2
+		}
+	}
+	return out
+}
+
+// runsXor returns the symmetric difference of two sorted lists of (start, last) pairs.
+func runsXor(a, b []uint16) []uint16 {
+	return runsAndNot(runsOr(a, b), runsAnd(a, b))
+}
+
+// runsAndCardinality returns the cardinality of the intersection of two sorted lists of
+// (start, last) pairs.
+func runsAndCardinality(a, b []uint16) int {
+	var num, i, j int
+	for i < len(a) && j < len(b) {
+		s := max16(a[i], b[j])
+		l := min16(a[i+1], b[j+1])
+		if s <= l {
+			num += int(l-s) + 1
+		}
+		if a[i+1] < b[j+1] {
+			i += 2
+		} else {
+			j += 2
+		}
+	}
+	return num
+}
+
+// runsIntersect returns true if two sorted lists of (start, last) pairs have an element in common.
+func runsIntersect(a, b []uint16) bool {
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if max16(a[i], b[j]) <= min16(a[i+1], b[j+1]) {
+			return true
+		}
+		if a[i+1] < b[j+1] {
+			i += 2
+		} else {
+			j += 2
+		}
+	}
+	return false
+}
+
+// runsAndNot returns the elements in a which are not in b, where both a and b are sorted lists of
+// (start, last) pairs.
+func runsAndNot(a, b []uint16) []uint16 {
+	var out []uint16
+	var j int
+	for i := 0; i < len(a); i += 2 {
+		s, l := int(a[i]), int(a[i+1])
+		// Skip over the runs in b which end before this run starts.
+		for j < len(b) && int(b[j+1]) < s {
+			j += 2
+		}
+		// The runs in b starting at j might overlap with [s, l]. Don't advance j here, because the
+		// last overlapping run might overlap with the next run in a as well.
+		for k := j; k < len(b) && int(b[k]) <= l && s <= l; k += 2 {
+			if int(b[k]) > s {
+				out = append(out, uint16(s), b[k]-1)
+			}
+			s = int(b[k+1]) + 1
+		}
+		if s <= l {
+			out = append(out, uint16(s), uint16(l))
+		}
+	}
+	return out
+}
+
 var (
 	runInline = 0x01
 	runLazy   = 0x02
@@ -705,6 +1607,32 @@ func containerOr(ac, bc, buf []uint16, runMode int) []uint16 {
 		right := bitmap(bc)
 		return left.orBitmap(right, buf, runMode)
 	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.orRun(right)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.orRun(right, buf, runMode)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		// Copy over the bitmap to buf, and then add the runs to it.
+		copy(buf, bc)
+		bitmap(buf).orRun(left, nil, runMode|runInline)
+		return buf
+	}
+	// Merge the runs, and pick the smallest encoding for the result, like addRange does.
+	if at == typeRun && bt == typeArray {
+		return optimizeContainer(runContainerFrom(runsOr(run(ac).runs(), array(bc).toRuns())))
+	}
+	if at == typeArray && bt == typeRun {
+		return optimizeContainer(runContainerFrom(runsOr(run(bc).runs(), array(ac).toRuns())))
+	}
 	panic("containerOr: We should not reach here")
 }
 
@@ -733,6 +1661,33 @@ func containerAnd(ac, bc []uint16) []uint16 {
 		right := bitmap(bc)
 		return left.andBitmap(right)
 	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andRun(right)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andArray(right)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return right.andArray(left)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.andBitmap(right)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return right.andBitmap(left)
+	}
 	panic("containerAnd: We should not reach here")
 }
 
@@ -762,5 +1717,163 @@ func containerAndNot(ac, bc, buf []uint16) []uint16 {
 		right := bitmap(bc)
 		return left.andNotBitmap(right)
 	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andNotArray(right)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.andNotBitmap(right, buf)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.andNotRun(right)
+	}
 	panic("containerAndNot: We should not reach here")
 }
+
+// containerAndCardinality returns the cardinality of the intersection of the two containers,
+// without allocating any memory.
+func containerAndCardinality(ac, bc []uint16) int {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		return intersection2by2Cardinality(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray && bt == typeBitmap {
+		return bitmap(bc).andArrayCardinality(array(ac))
+	}
+	if at == typeBitmap && bt == typeArray {
+		return bitmap(ac).andArrayCardinality(array(bc))
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		return bitmap(ac).andBitmapCardinality(bitmap(bc))
+	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		return runsAndCardinality(run(ac).runs(), run(bc).runs())
+	}
+	if at == typeRun && bt == typeArray {
+		return run(ac).andArrayCardinality(array(bc))
+	}
+	if at == typeArray && bt == typeRun {
+		return run(bc).andArrayCardinality(array(ac))
+	}
+	if at == typeRun && bt == typeBitmap {
+		return bitmap(bc).andRunCardinality(run(ac))
+	}
+	if at == typeBitmap && bt == typeRun {
+		return bitmap(ac).andRunCardinality(run(bc))
+	}
+	panic("containerAndCardinality: We should not reach here")
+}
+
+// containerIntersects returns true if the two containers have at least one element in common.
+func containerIntersects(ac, bc []uint16) bool {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		return intersects2by2(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray && bt == typeBitmap {
+		return bitmap(bc).intersectsArray(array(ac))
+	}
+	if at == typeBitmap && bt == typeArray {
+		return bitmap(ac).intersectsArray(array(bc))
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		return bitmap(ac).intersectsBitmap(bitmap(bc))
+	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		return runsIntersect(run(ac).runs(), run(bc).runs())
+	}
+	if at == typeRun && bt == typeArray {
+		return run(ac).intersectsArray(array(bc))
+	}
+	if at == typeArray && bt == typeRun {
+		return run(bc).intersectsArray(array(ac))
+	}
+	if at == typeRun && bt == typeBitmap {
+		return bitmap(bc).intersectsRun(run(ac))
+	}
+	if at == typeBitmap && bt == typeRun {
+		return bitmap(ac).intersectsRun(run(bc))
+	}
+	panic("containerIntersects: We should not reach here")
+}
+
+// containerXor returns the symmetric difference of the two containers. It doesn't modify either
+// of them. The result might be pointing to buf.
+func containerXor(ac, bc, buf []uint16) []uint16 {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		left := array(ac)
+		right := array(bc)
+		return left.xorArray(right)
+	}
+	if at == typeArray && bt == typeBitmap {
+		left := array(ac)
+		right := bitmap(bc)
+		return left.xorBitmap(right, buf)
+	}
+	if at == typeBitmap && bt == typeArray {
+		left := bitmap(ac)
+		right := array(bc)
+		return right.xorBitmap(left, buf)
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		left := bitmap(ac)
+		right := bitmap(bc)
+		return left.xorBitmap(right)
+	}
+
+	// Run containers.
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.xorRun(right)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.xorArray(right)
+	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return right.xorArray(left)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return right.xorRun(left, buf)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.xorRun(right, buf)
+	}
+	panic("containerXor: We should not reach here")
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import "io"
+
+// ImmutableBitmap is a bitmap which can't be modified. It only exposes the methods which don't
+// modify the bitmap, so it can safely refer to a buffer owned by someone else. The binary
+// operations return new bitmaps, which can be modified.
+type ImmutableBitmap struct {
+	bm *Bitmap
+}
+
+// FromBufferImmutable returns an immutable bitmap corresponding to the given buffer, without
+// copying it. Like FromBuffer, it panics if it can't understand the header of the buffer.
+func FromBufferImmutable(data []byte) *ImmutableBitmap {
+	bm := FromBuffer(data)
+	bm.readOnly = true
+	return &ImmutableBitmap{bm: bm}
+}
+
+// ToImmutable returns an immutable bitmap sharing the buffer of ra. The buffer is copied the next
+// time ra is modified, so that the immutable bitmap isn't affected.
+func (ra *Bitmap) ToImmutable() *ImmutableBitmap {
+	if !ra.readOnly {
+		ra.copyOnWrite = true
+	}
+	return &ImmutableBitmap{bm: ra.view(true)}
+}
+
+// view returns a bitmap sharing the buffer of ra.
+func (ra *Bitmap) view(readOnly bool) *Bitmap {
+	return &Bitmap{
+		data:        ra.data,
+		keys:        ra.keys,
+		_ptr:        ra._ptr,
+		checksum:    ra.checksum,
+		hasChecksum: ra.hasChecksum,
+		readOnly:    readOnly,
+		copyOnWrite: !readOnly,
+	}
+}
+
+// ToMutable returns a bitmap with the same contents, which can be modified. The buffer is shared
+// until the first modification of the returned bitmap, when it gets copied.
+func (im *ImmutableBitmap) ToMutable() *Bitmap {
+	return im.bm.view(false)
+}
+
+// Bitmap returns the underlying bitmap, so that it can be passed to the functions accepting a
+// *Bitmap. The returned bitmap is read-only, and the methods modifying it panic with ErrReadOnly.
+func (im *ImmutableBitmap) Bitmap() *Bitmap {
+	return im.bm
+}
+
+// The following methods are the same as the corresponding methods of Bitmap.
+
+func (im *ImmutableBitmap) Contains(x uint64) bool          { return im.bm.Contains(x) }
+func (im *ImmutableBitmap) Rank(x uint64) int               { return im.bm.Rank(x) }
+func (im *ImmutableBitmap) Select(x uint64) (uint64, error) { return im.bm.Select(x) }
+func (im *ImmutableBitmap) GetCardinality() int             { return im.bm.GetCardinality() }
+func (im *ImmutableBitmap) IsEmpty() bool                   { return im.bm.IsEmpty() }
+func (im *ImmutableBitmap) Minimum() uint64                 { return im.bm.Minimum() }
+func (im *ImmutableBitmap) Maximum() uint64                 { return im.bm.Maximum() }
+func (im *ImmutableBitmap) ToArray() []uint64               { return im.bm.ToArray() }
+func (im *ImmutableBitmap) String() string                  { return im.bm.String() }
+
+func (im *ImmutableBitmap) NewIterator() *Iterator { return im.bm.NewIterator() }
+func (im *ImmutableBitmap) NewIteratorRange(lo, hi uint64) *Iterator {
+	return im.bm.NewIteratorRange(lo, hi)
+}
+func (im *ImmutableBitmap) NewReverseIterator() *ReverseIterator {
+	return im.bm.NewReverseIterator()
+}
+func (im *ImmutableBitmap) NewRangeIterators(numRanges int) []*Iterator {
+	return im.bm.NewRangeIterators(numRanges)
+}
+func (im *ImmutableBitmap) ParallelIterators(n int) []*Iterator {
+	return im.bm.ParallelIterators(n)
+}
+
+// ToBuffer returns a copy of the buffer of the bitmap, which can be read by FromBuffer.
+func (im *ImmutableBitmap) ToBuffer() []byte                   { return im.bm.ToBufferWithCopy() }
+func (im *ImmutableBitmap) WriteTo(w io.Writer) (int64, error) { return im.bm.WriteTo(w) }
+func (im *ImmutableBitmap) MarshalBinary() ([]byte, error)     { return im.bm.MarshalBinary() }
+func (im *ImmutableBitmap) Verify() error                      { return im.bm.Verify() }
+
+func (im *ImmutableBitmap) And(bm *Bitmap) *Bitmap    { return And(im.bm, bm) }
+func (im *ImmutableBitmap) Or(bm *Bitmap) *Bitmap     { return Or(im.bm, bm) }
+func (im *ImmutableBitmap) AndNot(bm *Bitmap) *Bitmap { return AndNot(im.bm, bm) }
+func (im *ImmutableBitmap) Xor(bm *Bitmap) *Bitmap    { return Xor(im.bm, bm) }
+
+func (im *ImmutableBitmap) AndCardinality(bm *Bitmap) int    { return im.bm.AndCardinality(bm) }
+func (im *ImmutableBitmap) OrCardinality(bm *Bitmap) int     { return im.bm.OrCardinality(bm) }
+func (im *ImmutableBitmap) AndNotCardinality(bm *Bitmap) int { return im.bm.AndNotCardinality(bm) }
+func (im *ImmutableBitmap) XorCardinality(bm *Bitmap) int    { return im.bm.XorCardinality(bm) }
+func (im *ImmutableBitmap) Intersects(bm *Bitmap) bool       { return im.bm.Intersects(bm) }
+func (im *ImmutableBitmap) IsSubsetOf(bm *Bitmap) bool       { return im.bm.IsSubsetOf(bm) }
+func (im *ImmutableBitmap) IsSupersetOf(bm *Bitmap) bool     { return im.bm.IsSupersetOf(bm) }
+func (im *ImmutableBitmap) Equals(bm *Bitmap) bool           { return im.bm.Equals(bm) }
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableBitmap(t *testing.T) {
+	a := NewBitmap()
+	for i := 0; i < 1e4; i++ {
+		a.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	a.AddRange(1<<30, 1<<30+1e5)
+	vals := a.ToArray()
+
+	buf := a.ToBufferWithCopy()
+	orig := append([]byte{}, buf...)
+	im := FromBufferImmutable(buf)
+	require.Equal(t, vals, im.ToArray())
+	require.Equal(t, len(vals), im.GetCardinality())
+	require.True(t, im.Contains(vals[10]))
+	require.Equal(t, 10, im.Rank(vals[10]))
+	x, err := im.Select(10)
+	require.NoError(t, err)
+	require.Equal(t, vals[10], x)
+	require.Equal(t, vals[0], im.Minimum())
+	require.Equal(t, vals[len(vals)-1], im.Maximum())
+
+	b := FromRange(0, 1<<20)
+	require.Equal(t, And(a, b).ToArray(), im.And(b).ToArray())
+	require.Equal(t, Or(a, b).ToArray(), im.Or(b).ToArray())
+	require.Equal(t, AndNot(a, b).ToArray(), im.AndNot(b).ToArray())
+	require.Equal(t, Xor(a, b).ToArray(), im.Xor(b).ToArray())
+	require.Equal(t, a.AndCardinality(b), im.AndCardinality(b))
+	require.True(t, im.Equals(a))
+
+	// The binary operations return modifiable bitmaps.
+	res := im.And(b)
+	res.Set(1 << 50)
+	require.True(t, res.Contains(1<<50))
+
+	// The underlying bitmap can't be modified.
+	require.PanicsWithValue(t, ErrReadOnly, func() { im.Bitmap().Set(1) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { FastAnd(im.Bitmap(), b) })
+
+	// The mutable copy doesn't modify the buffer.
+	m := im.ToMutable()
+	for i := uint64(0); i < 1000; i++ {
+		m.Set(i)
+	}
+	m.Remove(vals[10])
+	require.Equal(t, orig, buf)
+	require.Equal(t, vals, im.ToArray())
+	require.False(t, m.Contains(vals[10]))
+	require.True(t, m.Contains(999))
+}
+
+func TestToImmutable(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e4; i += 3 {
+		a.Set(i)
+	}
+	vals := a.ToArray()
+
+	im := a.ToImmutable()
+	require.Equal(t, vals, im.ToArray())
+
+	// Modifying the source copies its buffer first.
+	a.Set(1)
+	a.RemoveRange(100, 200)
+	require.True(t, a.Contains(1))
+	require.False(t, a.Contains(102))
+	require.Equal(t, vals, im.ToArray())
+
+	// Read-only bitmaps stay read-only.
+	ro := im.Bitmap().ToImmutable()
+	require.Equal(t, vals, ro.ToArray())
+	require.PanicsWithValue(t, ErrReadOnly, func() { im.Bitmap().Set(1) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { ro.Bitmap().Set(1) })
+}
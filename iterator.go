@@ -17,7 +17,9 @@
 package sroar
 
 import (
+	"math"
 	"math/bits"
+	"sort"
 )
 
 type Iterator struct {
@@ -30,9 +32,23 @@ type Iterator struct {
 
 	bitmapIdx int
 	bitset    uint16
+
+	// runIdx is the index of the current run in a run container, and runVal is the next value to
+	// be returned from that run.
+	runIdx int
+	runVal int
+
+	// last is the largest value the iterator may return.
+	last uint64
 }
 
+// NewRangeIterators splits the containers of the bitmap evenly among numRanges iterators. The
+// iterators can get very different numbers of values, because the containers can. Use
+// ParallelIterators to split the values evenly.
 func (bm *Bitmap) NewRangeIterators(numRanges int) []*Iterator {
+	if numRanges <= 0 {
+		return nil
+	}
 	keyn := bm.keys.numKeys()
 	iters := make([]*Iterator, numRanges)
 	width := keyn / numRanges
@@ -53,6 +69,38 @@ func (bm *Bitmap) NewRangeIterators(numRanges int) []*Iterator {
 	return iters
 }
 
+// ParallelIterators splits the values of the bitmap into n iterators over consecutive ranges of
+// values, such that the number of values returned by any two iterators differs by at most one. The
+// boundaries are found using the cardinalities of the containers, so the containers in between are
+// not read.
+func (bm *Bitmap) ParallelIterators(n int) []*Iterator {
+	if n <= 0 {
+		return nil
+	}
+	total := bm.GetCardinality()
+
+	// bounds[i] is the first value of the ith iterator, which is the value at rank i*total/n.
+	bounds := make([]uint64, n)
+	var i, cum int
+	for ki := 0; ki < bm.keys.numKeys() && i < n; ki++ {
+		con := bm.getContainer(bm.keys.val(ki))
+		c := getCardinality(con)
+		for ; i < n && i*total/n < cum+c; i++ {
+			bounds[i] = bm.keys.key(ki) | uint64(selectContainer(con, i*total/n-cum))
+		}
+		cum += c
+	}
+
+	iters := make([]*Iterator, n)
+	for i := 0; i < n-1; i++ {
+		iters[i] = bm.NewIteratorRange(bounds[i], bounds[i+1])
+	}
+	// The last iterator must include math.MaxUint64, which can't be the end of a range.
+	iters[n-1] = bm.NewIterator()
+	iters[n-1].AdvanceIfNeeded(bounds[n-1])
+	return iters
+}
+
 func (bm *Bitmap) NewIterator() *Iterator {
 	return &Iterator{
 		bm:        bm,
@@ -60,10 +108,40 @@ func (bm *Bitmap) NewIterator() *Iterator {
 		keyIdx:    0,
 		contIdx:   -1,
 		bitmapIdx: -1,
+		runIdx:    -1,
+		last:      math.MaxUint64,
 	}
 }
 
+// NewIteratorRange returns an iterator over the values of the bitmap in [lo, hi). The iterator
+// starts directly at the first value >= lo, without iterating over the values before it.
+func (bm *Bitmap) NewIteratorRange(lo, hi uint64) *Iterator {
+	it := bm.NewIterator()
+	if lo >= hi {
+		it.keys = nil
+		return it
+	}
+	it.last = hi - 1
+
+	// Drop the containers beyond the range.
+	n := sort.Search(len(it.keys)/2, func(i int) bool {
+		return it.keys[2*i] > it.last&mask
+	})
+	it.keys = it.keys[:2*n]
+	it.AdvanceIfNeeded(lo)
+	return it
+}
+
 func (it *Iterator) Next() (uint64, bool) {
+	v, ok := it.next()
+	if ok && v > it.last {
+		it.keys = nil
+		return 0, false
+	}
+	return v, ok
+}
+
+func (it *Iterator) next() (uint64, bool) {
 	if len(it.keys) == 0 {
 		return 0, false
 	}
@@ -81,9 +159,7 @@ func (it *Iterator) Next() (uint64, bool) {
 		}
 		// jump by 2 because key is followed by a value
 		it.keyIdx += 2
-		it.contIdx = -1
-		it.bitmapIdx = -1
-		it.bitset = 0
+		it.resetContainer()
 		key = it.keys[it.keyIdx]
 		off = it.keys[it.keyIdx+1]
 		cont = it.bm.getContainer(off)
@@ -110,32 +186,283 @@ func (it *Iterator) Next() (uint64, bool) {
 		msb := 1 << (16 - msbIdx - 1)
 		it.bitset ^= uint16(msb)
 		return key | uint64(it.bitmapIdx*16+int(msbIdx)), true
+	case typeRun:
+		// Move to the next run if we have exhausted the current one.
+		r := run(cont)
+		if it.runIdx < 0 || it.runVal > int(r.last(it.runIdx)) {
+			it.runIdx++
+			it.runVal = int(r.start(it.runIdx))
+		}
+		val := it.runVal
+		it.runVal++
+		return key | uint64(val), true
 	}
 	return 0, false
 }
 
-type ManyItr struct {
-	index int
-	arr   []uint64
+// resetContainer resets the variables responsible for container iteration, so that the current
+// container is iterated from its start.
+func (it *Iterator) resetContainer() {
+	it.contIdx = -1
+	it.bitmapIdx = -1
+	it.bitset = 0
+	it.runIdx = -1
 }
 
-// TODO: See if this is needed, we should remove this
-func (r *Bitmap) ManyIterator() *ManyItr {
-	return &ManyItr{
-		arr: r.ToArray(),
+// PeekNext returns the value which would be returned by the next call to Next, without advancing
+// the iterator.
+func (it *Iterator) PeekNext() (uint64, bool) {
+	cp := *it
+	return cp.Next()
+}
+
+// AdvanceIfNeeded advances the iterator, so that the next call to Next returns the smallest value
+// >= x. If the next value is already >= x, the iterator is not moved. It can be used to
+// intersect bitmaps lazily, by skipping the values not present in the other bitmaps.
+func (it *Iterator) AdvanceIfNeeded(x uint64) {
+	if v, ok := it.PeekNext(); !ok || v >= x {
+		return
+	}
+
+	// The next value is < x, so the iterator is positioned at a container with key <= x&mask.
+	key := x & mask
+	if it.keys[it.keyIdx] < key {
+		n := len(it.keys) / 2
+		i := it.keyIdx/2 + sort.Search(n-it.keyIdx/2, func(i int) bool {
+			return it.keys[it.keyIdx+2*i] >= key
+		})
+		if i == n {
+			it.keys = nil
+			return
+		}
+		it.keyIdx = 2 * i
+		it.resetContainer()
+		if it.keys[it.keyIdx] > key {
+			return
+		}
+	}
+	it.advanceInContainer(uint16(x))
+}
+
+// advanceInContainer advances the iterator within the current container, so that the next value
+// returned is the smallest value >= x in it. If there's no such value, the container is marked as
+// exhausted, and Next moves to the next container.
+func (it *Iterator) advanceInContainer(x uint16) {
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+	switch cont[indexType] {
+	case typeArray:
+		it.contIdx = array(cont).find(x) - 1
+	case typeBitmap:
+		// Count the values skipped, so that contIdx stays the number of values consumed - 1.
+		idx := int(x >> 4)
+		for it.bitmapIdx < idx {
+			it.contIdx += bits.OnesCount16(it.bitset)
+			it.bitmapIdx++
+			it.bitset = cont[int(startIdx)+it.bitmapIdx]
+		}
+		// Clear the bits for the values < x in the current word.
+		rem := uint16(0xFFFF) >> (x & 0xF)
+		it.contIdx += bits.OnesCount16(it.bitset &^ rem)
+		it.bitset &= rem
+	case typeRun:
+		r := run(cont)
+		n := r.numRuns()
+		ri, val := it.runIdx, it.runVal
+		if ri < 0 || val > int(r.last(ri)) {
+			ri++
+			if ri < n {
+				val = int(r.start(ri))
+			}
+		}
+		for ri < n && int(r.last(ri)) < int(x) {
+			it.contIdx += int(r.last(ri)) - val + 1
+			ri++
+			if ri < n {
+				val = int(r.start(ri))
+			}
+		}
+		if ri < n && val < int(x) {
+			it.contIdx += int(x) - val
+			val = int(x)
+		}
+		it.runIdx, it.runVal = ri, val
+	}
+}
+
+// ReverseIterator iterates over the values of a bitmap in descending order.
+type ReverseIterator struct {
+	bm *Bitmap
+
+	keys []uint64
+	// keyIdx is the index of the key of the current container in keys.
+	keyIdx int
+	cont   []uint16
+
+	// contIdx is the number of values left in an array container.
+	contIdx int
+
+	// bitmapIdx is the index of the current word in a bitmap container, and bitset holds the bits
+	// of the values left in that word.
+	bitmapIdx int
+	bitset    uint16
+
+	// runIdx is the index of the current run in a run container, and runVal is the next value to
+	// be returned from that run.
+	runIdx int
+	runVal int
+}
+
+// NewReverseIterator returns an iterator, which starts at the maximum of the bitmap and returns
+// its values in descending order.
+func (bm *Bitmap) NewReverseIterator() *ReverseIterator {
+	keys := bm.keys[indexNodeStart : indexNodeStart+bm.keys.numKeys()*2]
+	return &ReverseIterator{
+		bm:     bm,
+		keys:   keys,
+		keyIdx: len(keys),
+	}
+}
+
+func (it *ReverseIterator) Next() (uint64, bool) {
+	for {
+		if it.keyIdx < len(it.keys) {
+			if v, ok := it.nextInContainer(); ok {
+				return it.keys[it.keyIdx] | uint64(v), true
+			}
+		}
+		if it.keyIdx == 0 {
+			return 0, false
+		}
+
+		// Move to the previous container, and start from its end.
+		it.keyIdx -= 2
+		it.cont = it.bm.getContainer(it.keys[it.keyIdx+1])
+		switch it.cont[indexType] {
+		case typeArray:
+			it.contIdx = getCardinality(it.cont)
+		case typeBitmap:
+			it.bitmapIdx = len(it.cont) - int(startIdx)
+			it.bitset = 0
+		case typeRun:
+			it.runIdx = run(it.cont).numRuns()
+			it.runVal = -1
+		}
 	}
+}
 
+func (it *ReverseIterator) nextInContainer() (uint16, bool) {
+	cont := it.cont
+	switch cont[indexType] {
+	case typeArray:
+		if it.contIdx == 0 {
+			return 0, false
+		}
+		it.contIdx--
+		return cont[int(startIdx)+it.contIdx], true
+	case typeBitmap:
+		for it.bitset == 0 {
+			if it.bitmapIdx == 0 {
+				return 0, false
+			}
+			it.bitmapIdx--
+			it.bitset = cont[int(startIdx)+it.bitmapIdx]
+		}
+		// The value at position p in a word is stored in bit 15-p, so the largest value in the
+		// word is the least-significant set bit.
+		tz := bits.TrailingZeros16(it.bitset)
+		it.bitset &^= 1 << tz
+		return uint16(it.bitmapIdx*16 + 15 - tz), true
+	case typeRun:
+		r := run(cont)
+		// Move to the previous run if we have exhausted the current one.
+		if it.runVal < 0 || it.runVal < int(r.start(it.runIdx)) {
+			if it.runIdx == 0 {
+				return 0, false
+			}
+			it.runIdx--
+			it.runVal = int(r.last(it.runIdx))
+		}
+		val := it.runVal
+		it.runVal--
+		return uint16(val), true
+	}
+	return 0, false
 }
 
+// ManyItr returns the values of a bitmap in batches. The values are decoded from the containers
+// as they are needed, so it uses constant memory regardless of the size of the bitmap.
+type ManyItr struct {
+	it Iterator
+}
+
+// ManyIterator returns a ManyItr over the values of the bitmap.
+func (r *Bitmap) ManyIterator() *ManyItr {
+	return &ManyItr{it: *r.NewIterator()}
+}
+
+// NextMany fills buf with the next values of the bitmap, and returns the number of values filled.
+// It returns 0 once the bitmap is exhausted.
 func (itr *ManyItr) NextMany(buf []uint64) int {
-	count := 0
-	for i := 0; i < len(buf); i++ {
-		if itr.index == len(itr.arr) {
-			break
+	it := &itr.it
+	var n int
+	for n < len(buf) && len(it.keys) > 0 {
+		key := it.keys[it.keyIdx]
+		cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+		card := getCardinality(cont)
+		if it.contIdx+1 >= card {
+			if it.keyIdx+2 >= len(it.keys) {
+				break
+			}
+			it.keyIdx += 2
+			it.resetContainer()
+			continue
+		}
+
+		switch cont[indexType] {
+		case typeArray:
+			vals := cont[int(startIdx)+it.contIdx+1 : int(startIdx)+card]
+			if len(vals) > len(buf)-n {
+				vals = vals[:len(buf)-n]
+			}
+			for i, x := range vals {
+				buf[n+i] = key | uint64(x)
+			}
+			n += len(vals)
+			it.contIdx += len(vals)
+		case typeBitmap:
+			for n < len(buf) && it.contIdx+1 < card {
+				for it.bitset == 0 {
+					it.bitmapIdx++
+					it.bitset = cont[int(startIdx)+it.bitmapIdx]
+				}
+				msbIdx := bits.LeadingZeros16(it.bitset)
+				it.bitset ^= 1 << (15 - msbIdx)
+				buf[n] = key | uint64(it.bitmapIdx*16+msbIdx)
+				n++
+				it.contIdx++
+			}
+		case typeRun:
+			r := run(cont)
+			for n < len(buf) && it.contIdx+1 < card {
+				if it.runIdx < 0 || it.runVal > int(r.last(it.runIdx)) {
+					it.runIdx++
+					it.runVal = int(r.start(it.runIdx))
+				}
+				m := min(int(r.last(it.runIdx))-it.runVal+1, len(buf)-n)
+				for i := 0; i < m; i++ {
+					buf[n+i] = key | uint64(it.runVal+i)
+				}
+				n += m
+				it.runVal += m
+				it.contIdx += m
+			}
 		}
-		buf[i] = itr.arr[itr.index]
-		itr.index++
-		count++
 	}
-	return count
+	return n
+}
+
+// AdvanceIfNeeded advances the iterator, so that the next value returned by NextMany is the
+// smallest value >= x. If the next value is already >= x, the iterator is not moved.
+func (itr *ManyItr) AdvanceIfNeeded(x uint64) {
+	itr.it.AdvanceIfNeeded(x)
 }
@@ -17,6 +17,7 @@
 package sroar
 
 import (
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
@@ -58,6 +59,54 @@ func TestIteratorRanges(t *testing.T) {
 	}
 }
 
+func TestIteratorRangesInvalid(t *testing.T) {
+	bm := FromSortedList([]uint64{1, 1 << 16, 1 << 17})
+	require.Nil(t, bm.NewRangeIterators(0))
+	require.Nil(t, bm.NewRangeIterators(-1))
+}
+
+func TestParallelIterators(t *testing.T) {
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	// A dense container followed by sparse ones.
+	skewed := FromRange(0, 1<<16)
+	for i := uint64(1); i < 64; i++ {
+		skewed.Set(i << 16)
+	}
+	bms := []*Bitmap{NewBitmap(), sparse, dense, skewed,
+		FromSortedList([]uint64{0, 5, math.MaxUint64})}
+
+	for i, bm := range bms {
+		arr := bm.ToArray()
+		for _, n := range []int{1, 2, 3, 8, 100, 5000} {
+			iters := bm.ParallelIterators(n)
+			require.Len(t, iters, n)
+
+			var got []uint64
+			for _, it := range iters {
+				var cnt int
+				for v, ok := it.Next(); ok; v, ok = it.Next() {
+					got = append(got, v)
+					cnt++
+				}
+				require.True(t, cnt == len(arr)/n || cnt == len(arr)/n+1,
+					"bitmap %d, %d iterators: %d values out of %d", i, n, cnt, len(arr))
+			}
+			require.Equal(t, len(arr), len(got))
+			if len(arr) > 0 {
+				require.Equal(t, arr, got)
+			}
+		}
+	}
+	require.Nil(t, NewBitmap().ParallelIterators(0))
+}
+
 func TestIteratorRandom(t *testing.T) {
 	n := uint64(1e6)
 	bm := NewBitmap()
@@ -104,6 +153,196 @@ func TestIteratorWithRemoveKeys(t *testing.T) {
 	require.Equal(t, 0, cnt)
 }
 
+func TestIteratorAdvance(t *testing.T) {
+	// Array, bitmap and run containers, and an empty container to skip over.
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	dense.Set(1 << 21)
+	dense.Remove(1 << 21)
+	dense.Set(1 << 22)
+	runs := FromRange(1<<20, 1<<21)
+	runs.AddRange(1<<23, 1<<23+100)
+
+	for i, bm := range []*Bitmap{NewBitmap(), sparse, dense, runs} {
+		arr := bm.ToArray()
+		it := bm.NewIterator()
+		var pos int
+		for x := uint64(0); x < 1<<24+100; x += uint64(rand.Intn(1 << 14)) {
+			it.AdvanceIfNeeded(x)
+			for pos < len(arr) && arr[pos] < x {
+				pos++
+			}
+			v, ok := it.PeekNext()
+			require.Equal(t, pos < len(arr), ok, "bitmap %d at %d", i, x)
+			if !ok {
+				break
+			}
+			require.Equal(t, arr[pos], v)
+
+			// Consume a few values.
+			for j := rand.Intn(3); j >= 0 && pos < len(arr); j-- {
+				v, ok := it.Next()
+				require.True(t, ok)
+				require.Equal(t, arr[pos], v)
+				pos++
+			}
+		}
+	}
+
+	// Advancing to a smaller value doesn't move the iterator.
+	bm := FromSortedList([]uint64{10, 20, 1 << 20, 1 << 30})
+	it := bm.NewIterator()
+	it.AdvanceIfNeeded(15)
+	it.AdvanceIfNeeded(5)
+	v, ok := it.Next()
+	require.True(t, ok)
+	require.Equal(t, uint64(20), v)
+	it.AdvanceIfNeeded(1<<20 + 1)
+	v, _ = it.Next()
+	require.Equal(t, uint64(1<<30), v)
+	it.AdvanceIfNeeded(1 << 40)
+	_, ok = it.Next()
+	require.False(t, ok)
+	_, ok = it.PeekNext()
+	require.False(t, ok)
+}
+
+func TestIteratorAdvanceIntersect(t *testing.T) {
+	a, b := NewBitmap(), NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		a.Set(uint64(rand.Int63n(1 << 22)))
+		b.Set(uint64(rand.Int63n(1 << 22)))
+	}
+	b.AddRange(1<<20, 1<<21)
+	b.RunOptimize()
+
+	// Leapfrog join of the two bitmaps.
+	var res []uint64
+	ia, ib := a.NewIterator(), b.NewIterator()
+	for {
+		va, ok := ia.PeekNext()
+		if !ok {
+			break
+		}
+		ib.AdvanceIfNeeded(va)
+		vb, ok := ib.PeekNext()
+		if !ok {
+			break
+		}
+		if va == vb {
+			res = append(res, va)
+			ia.Next()
+			ib.Next()
+			continue
+		}
+		ia.AdvanceIfNeeded(vb)
+	}
+	require.Equal(t, And(a, b).ToArray(), res)
+}
+
+func TestIteratorRange(t *testing.T) {
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	runs := FromRange(1<<16-100, 1<<18)
+	runs.AddRange(1<<20+7, 1<<20+300)
+	bms := []*Bitmap{NewBitmap(), sparse, dense, runs,
+		FromSortedList([]uint64{0, 1, 1<<16 - 1, 1 << 16, math.MaxUint64})}
+	check := func(bm *Bitmap, lo, hi uint64) {
+		var exp []uint64
+		for _, x := range bm.ToArray() {
+			if x >= lo && x < hi {
+				exp = append(exp, x)
+			}
+		}
+		var got []uint64
+		it := bm.NewIteratorRange(lo, hi)
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			got = append(got, v)
+		}
+		require.Equal(t, exp, got, "range [%d, %d)", lo, hi)
+		_, ok := it.Next()
+		require.False(t, ok)
+	}
+
+	for _, bm := range bms {
+		check(bm, 0, math.MaxUint64)
+		check(bm, 0, 1<<16)
+		check(bm, 1<<16, 1<<17)
+		check(bm, 1<<16-1, 1<<16+1)
+		check(bm, 1<<20, 1<<20)
+		check(bm, 1<<30, math.MaxUint64)
+		for i := 0; i < 20; i++ {
+			lo := uint64(rand.Int63n(1 << 24))
+			check(bm, lo, lo+uint64(rand.Int63n(1<<18)))
+		}
+	}
+
+	// Page through the values by range.
+	bm := dense
+	var got []uint64
+	for lo := uint64(0); lo < 1<<24; lo += 1 << 18 {
+		it := bm.NewIteratorRange(lo, lo+1<<18)
+		for v, ok := it.Next(); ok; v, ok = it.Next() {
+			got = append(got, v)
+		}
+	}
+	require.Equal(t, bm.ToArray(), got)
+}
+
+func TestReverseIterator(t *testing.T) {
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 40)))
+	}
+	// The last container is empty, and has to be skipped first.
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	dense.Set(1 << 30)
+	dense.Remove(1 << 30)
+	runs := FromRange(0, 1<<17)
+	runs.AddRange(1<<20+10, 1<<20+1000)
+
+	bms := []*Bitmap{NewBitmap(), sparse, dense, runs,
+		FromSortedList([]uint64{0, 1, 1<<16 - 1, 1 << 16, math.MaxUint64})}
+	for i, bm := range bms {
+		arr := bm.ToArray()
+		it := bm.NewReverseIterator()
+		for j := len(arr) - 1; j >= 0; j-- {
+			v, ok := it.Next()
+			require.True(t, ok, "bitmap %d", i)
+			require.Equal(t, arr[j], v, "bitmap %d", i)
+		}
+		_, ok := it.Next()
+		require.False(t, ok)
+		_, ok = it.Next()
+		require.False(t, ok)
+	}
+
+	// Latest N values.
+	bm := NewBitmap()
+	bm.AddRange(100, 1<<20)
+	bm.RunOptimize()
+	it := bm.NewReverseIterator()
+	for i := uint64(1); i <= 10; i++ {
+		v, _ := it.Next()
+		require.Equal(t, uint64(1<<20)-i, v)
+	}
+}
+
 func TestManyIterator(t *testing.T) {
 	b := NewBitmap()
 	for i := 0; i < int(1e6); i++ {
@@ -125,6 +364,58 @@ func TestManyIterator(t *testing.T) {
 	}
 }
 
+func TestManyIteratorContainers(t *testing.T) {
+	// NextMany decodes array, bitmap and run containers, and skips empty ones.
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 24)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	mixed := FromRange(1<<20, 1<<20+3<<16)
+	mixed.Set(1 << 23)
+	mixed.Remove(1 << 23)
+	mixed.Or(*sparse)
+	mixed.Or(*dense)
+
+	for i, bm := range []*Bitmap{NewBitmap(), sparse, dense, mixed} {
+		arr := bm.ToArray()
+		for _, sz := range []int{1, 7, 1000, 1 << 17} {
+			mi := bm.ManyIterator()
+			buf := make([]uint64, sz)
+			var got []uint64
+			for n := mi.NextMany(buf); n > 0; n = mi.NextMany(buf) {
+				got = append(got, buf[:n]...)
+			}
+			require.Equal(t, len(arr), len(got), "bitmap %d, size %d", i, sz)
+			if len(arr) > 0 {
+				require.Equal(t, arr, got, "bitmap %d, size %d", i, sz)
+			}
+			require.Equal(t, 0, mi.NextMany(buf))
+		}
+
+		// Interleave AdvanceIfNeeded with NextMany.
+		mi := bm.ManyIterator()
+		buf := make([]uint64, 5)
+		var pos int
+		for x := uint64(0); ; x += uint64(rand.Intn(1 << 14)) {
+			mi.AdvanceIfNeeded(x)
+			for pos < len(arr) && arr[pos] < x {
+				pos++
+			}
+			n := mi.NextMany(buf)
+			require.Equal(t, min(5, len(arr)-pos), n, "bitmap %d at %d", i, x)
+			if n == 0 {
+				break
+			}
+			require.Equal(t, arr[pos:pos+n], buf[:n])
+			pos += n
+		}
+	}
+}
+
 func BenchmarkIterator(b *testing.B) {
 	bm := NewBitmap()
 	for i := 0; i < int(1e5); i++ {
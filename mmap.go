@@ -0,0 +1,99 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// MappedFile is a file holding a serialized bitmap, which is mapped into memory.
+type MappedFile struct {
+	data []byte
+	bm   *Bitmap
+}
+
+// OpenFile maps the file at the given path into memory, and returns it. The file must hold a
+// bitmap written by ToBuffer, ToBufferWithHeader or WriteTo. The bitmap isn't validated; use
+// Verify for that.
+//
+// The bitmap returned by MappedFile.Bitmap refers to the mapped memory, so it is read-only. The
+// methods modifying it panic with ErrReadOnly. Binary operations returning new bitmaps, like And
+// and Or, can be used with it, and Clone returns a modifiable copy. The bitmap must not be used
+// after the file is closed.
+func OpenFile(path string) (*MappedFile, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mf := &MappedFile{data: data}
+
+	h, body, err := readHeader(mf.data)
+	if err == nil && (len(body)%2 != 0 || (len(body) > 0 && len(body) < 8*indexNodeStart)) {
+		err = errors.Errorf("invalid buffer length: %d", len(body))
+	}
+	if err != nil {
+		mf.Close()
+		return nil, errors.Wrapf(err, "while reading %s", path)
+	}
+	mf.bm = fromBufferWithHeader(h, body)
+	mf.bm.readOnly = true
+	return mf, nil
+}
+
+// Bitmap returns the read-only bitmap held by the file.
+func (mf *MappedFile) Bitmap() *Bitmap {
+	return mf.bm
+}
+
+// Close unmaps the file. The bitmap returned by Bitmap must not be used afterwards.
+func (mf *MappedFile) Close() error {
+	if mf.data == nil {
+		return nil
+	}
+	err := munmap(mf.data)
+	mf.data = nil
+	return err
+}
+
+// mapFile maps the whole file at the given path into memory, as read-only. It returns nil for an
+// empty file.
+func mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int(fi.Size())
+	if int64(size) != fi.Size() {
+		return nil, errors.Errorf("file %s is too large: %d bytes", path, fi.Size())
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	data, err := mmap(f, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while mapping %s", path)
+	}
+	return data, nil
+}
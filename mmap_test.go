@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 7 {
+		a.Set(i)
+	}
+	a.AddRange(1<<30, 1<<30+1e5)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bitmap")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = a.WriteTo(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mf, err := OpenFile(path)
+	require.NoError(t, err)
+	bm := mf.Bitmap()
+	require.True(t, a.Equals(bm))
+	require.True(t, bm.Contains(14))
+	require.False(t, bm.Contains(15))
+	require.NoError(t, bm.Verify())
+
+	// Operations returning new bitmaps work.
+	b := FromRange(0, 1000)
+	require.Equal(t, And(a, b).ToArray(), And(bm, b).ToArray())
+	require.Equal(t, a.GetCardinality(), Or(bm, NewBitmap()).GetCardinality())
+	var cnt int
+	itr := bm.NewIterator()
+	for _, ok := itr.Next(); ok; _, ok = itr.Next() {
+		cnt++
+	}
+	require.Equal(t, a.GetCardinality(), cnt)
+
+	// Modifications panic, and don't touch the file.
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.Set(15) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.Remove(14) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.AddRange(1, 10) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.Or(*b) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.And(b) })
+	require.PanicsWithValue(t, ErrReadOnly, func() { bm.RunOptimize() })
+	require.Equal(t, ErrReadOnly, bm.UnmarshalBinary(a.ToBuffer()))
+	require.True(t, a.Equals(bm))
+
+	// Clones can be modified.
+	c := bm.Clone()
+	c.Set(15)
+	require.True(t, c.Contains(15))
+	require.False(t, bm.Contains(15))
+
+	require.NoError(t, mf.Close())
+	require.NoError(t, mf.Close())
+
+	// Legacy buffers.
+	require.NoError(t, os.WriteFile(path, a.ToBufferWithCopy(), 0644))
+	mf, err = OpenFile(path)
+	require.NoError(t, err)
+	require.True(t, a.Equals(mf.Bitmap()))
+	require.NoError(t, mf.Close())
+
+	// Empty files.
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	mf, err = OpenFile(path)
+	require.NoError(t, err)
+	require.True(t, mf.Bitmap().IsEmpty())
+	require.NoError(t, mf.Close())
+
+	// Invalid files.
+	require.NoError(t, os.WriteFile(path, a.ToBufferWithHeader()[:100], 0644))
+	_, err = OpenFile(path)
+	require.Error(t, err)
+	_, err = OpenFile(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
@@ -0,0 +1,497 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// The portable format is the serialization format shared by the Roaring implementations in Java,
+// C and Go. It is documented at https://github.com/RoaringBitmap/RoaringFormatSpec.
+//
+// A 32-bit portable bitmap starts with a cookie. If the bitmap has run containers, the cookie is
+// serialCookie in the lower 16 bits and the number of containers - 1 in the upper 16 bits,
+// followed by a bitset marking the run containers. Otherwise, it is serialCookieNoRun followed by
+// the number of containers as uint32. Next come the (key, cardinality - 1) pairs as uint16s, the
+// offsets of the containers as uint32s (skipped for small bitmaps with runs) and the containers.
+// A container is stored as a list of uint16s if it has at most arrayMaxCardinality elements, or
+// as 1024 uint64s otherwise. A run container is stored as the number of runs followed by
+// (start, length - 1) pairs. All the integers are in little-endian byte order.
+//
+// A 64-bit portable bitmap is the number of buckets as uint64, followed by each bucket as the
+// upper 32 bits of its values as uint32 and a 32-bit portable bitmap holding the lower 32 bits.
+//
+// sroar doesn't have the concept of buckets. The containers of a sroar bitmap are grouped by the
+// upper 32 bits of their keys instead.
+
+const (
+	serialCookieNoRun = 12346
+	serialCookie      = 12347
+
+	// noOffsetThreshold is the number of containers below which the offsets are not stored, if
+	// the bitmap has run containers.
+	noOffsetThreshold = 4
+
+	// arrayMaxCardinality is the maximum cardinality of an array container in the portable format.
+	arrayMaxCardinality = 4096
+
+	portableBitmapSize = 8192
+)
+
+// keyedContainer is a container along with its key.
+type keyedContainer struct {
+	key uint64
+	c   []uint16
+}
+
+// nonEmptyContainers returns the containers of the bitmap which have at least one element.
+func (ra *Bitmap) nonEmptyContainers() []keyedContainer {
+	var out []keyedContainer
+	if ra == nil {
+		return out
+	}
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		if getCardinality(c) == 0 {
+			continue
+		}
+		out = append(out, keyedContainer{key: ra.keys.key(i), c: c})
+	}
+	return out
+}
+
+// fromContainers returns a bitmap holding the given containers. The keys must be sorted.
+func fromContainers(conts []keyedContainer) *Bitmap {
+	ra := NewBitmap()
+	var numKeys int
+	for _, kc := range conts {
+		if kc.key != 0 {
+			numKeys++
+		}
+	}
+	ra.initSpaceForKeys(numKeys)
+
+	for _, kc := range conts {
+		off := ra.newContainer(uint16(len(kc.c)))
+		copy(ra.getContainer(off), kc.c)
+		ra.setKey(kc.key, off)
+	}
+	return ra
+}
+
+// ToPortable returns the bitmap serialized in the 32-bit portable Roaring format. It returns an
+// error if the bitmap has values which don't fit in 32 bits.
+func (ra *Bitmap) ToPortable() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := ra.WritePortableTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ToPortable64 returns the bitmap serialized in the 64-bit portable Roaring format.
+func (ra *Bitmap) ToPortable64() []byte {
+	var buf bytes.Buffer
+	// Writes to bytes.Buffer don't fail.
+	_, _ = ra.WritePortable64To(&buf)
+	return buf.Bytes()
+}
+
+// WritePortableTo writes the bitmap in the 32-bit portable Roaring format to w. It returns the
+// number of bytes written. Unlike WriteTo, which writes the native sroar format, the output can be
+// read by any Roaring implementation.
+func (ra *Bitmap) WritePortableTo(w io.Writer) (int64, error) {
+	conts := ra.nonEmptyContainers()
+	if n := len(conts); n > 0 && conts[n-1].key>>32 > 0 {
+		return 0, errors.Errorf("bitmap has values which don't fit in 32 bits")
+	}
+	return writePortable(w, conts)
+}
+
+// WritePortable64To writes the bitmap in the 64-bit portable Roaring format to w. It returns the
+// number of bytes written.
+func (ra *Bitmap) WritePortable64To(w io.Writer) (int64, error) {
+	conts := ra.nonEmptyContainers()
+
+	// Group the containers by the upper 32 bits of their keys.
+	var buckets [][]keyedContainer
+	for i, kc := range conts {
+		if i == 0 || kc.key>>32 != conts[i-1].key>>32 {
+			buckets = append(buckets, nil)
+		}
+		buckets[len(buckets)-1] = append(buckets[len(buckets)-1], kc)
+	}
+
+	written, err := w.Write(appendUint64(nil, uint64(len(buckets))))
+	n := int64(written)
+	if err != nil {
+		return n, err
+	}
+	for _, b := range buckets {
+		written, err := w.Write(appendUint32(nil, uint32(b[0].key>>32)))
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+		m, err := writePortable(w, b)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writePortable writes the given containers as a 32-bit portable bitmap. The containers must share
+// the upper 32 bits of their keys.
+func writePortable(w io.Writer, conts []keyedContainer) (int64, error) {
+	var hasRun bool
+	for _, kc := range conts {
+		if kc.c[indexType] == typeRun {
+			hasRun = true
+			break
+		}
+	}
+
+	var hdr []byte
+	if hasRun {
+		hdr = appendUint32(hdr, serialCookie|uint32(len(conts)-1)<<16)
+		runs := make([]byte, (len(conts)+7)/8)
+		for i, kc := range conts {
+			if kc.c[indexType] == typeRun {
+				runs[i/8] |= 1 << (i % 8)
+			}
+		}
+		hdr = append(hdr, runs...)
+	} else {
+		hdr = appendUint32(hdr, serialCookieNoRun)
+		hdr = appendUint32(hdr, uint32(len(conts)))
+	}
+	for _, kc := range conts {
+		hdr = appendUint16(hdr, uint16(kc.key>>16))
+		hdr = appendUint16(hdr, uint16(getCardinality(kc.c)-1))
+	}
+	if !hasRun || len(conts) >= noOffsetThreshold {
+		// Offsets are counted from the start of the bitmap.
+		off := len(hdr) + 4*len(conts)
+		for _, kc := range conts {
+			hdr = appendUint32(hdr, uint32(off))
+			off += portableSize(kc.c)
+		}
+	}
+
+	written, err := w.Write(hdr)
+	n := int64(written)
+	if err != nil {
+		return n, err
+	}
+	var buf []byte
+	for _, kc := range conts {
+		buf = appendPortable(buf[:0], kc.c)
+		written, err := w.Write(buf)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// portableType returns the type of the container in the portable format.
+func portableType(c []uint16) uint16 {
+	switch {
+	case c[indexType] == typeRun:
+		return typeRun
+	case getCardinality(c) <= arrayMaxCardinality:
+		return typeArray
+	default:
+		return typeBitmap
+	}
+}
+
+// portableSize returns the size of the container in bytes, in the portable format.
+func portableSize(c []uint16) int {
+	switch portableType(c) {
+	case typeRun:
+		return 2 + 4*run(c).numRuns()
+	case typeArray:
+		return 2 * getCardinality(c)
+	default:
+		return portableBitmapSize
+	}
+}
+
+// appendPortable appends the container in the portable format to buf.
+func appendPortable(buf []byte, c []uint16) []byte {
+	switch portableType(c) {
+	case typeRun:
+		r := run(c)
+		buf = appendUint16(buf, uint16(r.numRuns()))
+		for i := 0; i < r.numRuns(); i++ {
+			buf = appendUint16(buf, r.start(i))
+			buf = appendUint16(buf, r.last(i)-r.start(i))
+		}
+
+	case typeArray:
+		var vals []uint16
+		if c[indexType] == typeArray {
+			vals = array(c).all()
+		} else {
+			vals = bitmap(c).all()
+		}
+		for _, x := range vals {
+			buf = appendUint16(buf, x)
+		}
+
+	case typeBitmap:
+		b := bitmap(c)
+		if c[indexType] == typeArray {
+			b = array(c).toBitmapContainer(nil)
+		}
+		// sroar stores the bits of a uint16 starting from the most significant bit, while the
+		// portable format stores the bits of a uint64 starting from the least significant bit.
+		words := b[startIdx:]
+		for i := 0; i < len(words); i += 4 {
+			var x uint64
+			for j := 0; j < 4; j++ {
+				x |= uint64(bits.Reverse16(words[i+j])) << (16 * j)
+			}
+			buf = appendUint64(buf, x)
+		}
+	}
+	return buf
+}
+
+// FromPortable returns a bitmap read from the given buffer in the 32-bit portable Roaring format.
+func FromPortable(data []byte) (*Bitmap, error) {
+	return ReadPortableFrom(bytes.NewReader(data))
+}
+
+// FromPortable64 returns a bitmap read from the given buffer in the 64-bit portable Roaring format.
+func FromPortable64(data []byte) (*Bitmap, error) {
+	return ReadPortable64From(bytes.NewReader(data))
+}
+
+// ReadPortableFrom reads a bitmap in the 32-bit portable Roaring format from r. It doesn't read
+// beyond the end of the bitmap.
+func ReadPortableFrom(r io.Reader) (*Bitmap, error) {
+	pr := &portableReader{r: r}
+	conts, err := pr.readBitmap(0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fromContainers(conts), nil
+}
+
+// ReadPortable64From reads a bitmap in the 64-bit portable Roaring format from r. It doesn't read
+// beyond the end of the bitmap.
+func ReadPortable64From(r io.Reader) (*Bitmap, error) {
+	pr := &portableReader{r: r}
+	b, err := pr.read(8)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading number of buckets")
+	}
+	numBuckets := binary.LittleEndian.Uint64(b)
+
+	var conts []keyedContainer
+	var prev uint64
+	for i := uint64(0); i < numBuckets; i++ {
+		b, err := pr.read(4)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading key of bucket %d", i)
+		}
+		hi := uint64(binary.LittleEndian.Uint32(b))
+		if i > 0 && hi <= prev {
+			return nil, errors.Errorf("buckets are not sorted at index %d", i)
+		}
+		prev = hi
+		if conts, err = pr.readBitmap(hi, conts); err != nil {
+			return nil, errors.Wrapf(err, "while reading bucket %d", i)
+		}
+	}
+	return fromContainers(conts), nil
+}
+
+type portableReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// read returns the next n bytes. The returned slice is only valid until the next call to read.
+func (pr *portableReader) read(n int) ([]byte, error) {
+	if cap(pr.buf) < n {
+		pr.buf = make([]byte, n)
+	}
+	b := pr.buf[:n]
+	if _, err := io.ReadFull(pr.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readBitmap reads a 32-bit portable bitmap and appends its containers to conts. The given upper
+// 32 bits are added to the keys of the containers.
+func (pr *portableReader) readBitmap(hi uint64, conts []keyedContainer) ([]keyedContainer, error) {
+	b, err := pr.read(4)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading cookie")
+	}
+	cookie := binary.LittleEndian.Uint32(b)
+
+	var n int
+	var isRun []byte
+	switch {
+	case cookie&0xFFFF == serialCookie:
+		n = int(cookie>>16) + 1
+		b, err := pr.read((n + 7) / 8)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading run bitset")
+		}
+		isRun = append([]byte{}, b...)
+	case cookie == serialCookieNoRun:
+		b, err := pr.read(4)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading number of containers")
+		}
+		n = int(binary.LittleEndian.Uint32(b))
+		if n > 1<<16 {
+			return nil, errors.Errorf("invalid number of containers: %d", n)
+		}
+	default:
+		return nil, errors.Errorf("invalid cookie: %d", cookie)
+	}
+
+	b, err = pr.read(4 * n)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading container keys")
+	}
+	keys := make([]uint16, n)
+	cards := make([]int, n)
+	for i := 0; i < n; i++ {
+		keys[i] = binary.LittleEndian.Uint16(b[4*i:])
+		cards[i] = int(binary.LittleEndian.Uint16(b[4*i+2:])) + 1
+		if i > 0 && keys[i] <= keys[i-1] {
+			return nil, errors.Errorf("container keys are not sorted at index %d", i)
+		}
+	}
+	if isRun == nil || n >= noOffsetThreshold {
+		// The containers are read sequentially. So, we don't need the offsets.
+		if _, err := pr.read(4 * n); err != nil {
+			return nil, errors.Wrap(err, "while reading container offsets")
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		var c []uint16
+		var err error
+		switch {
+		case isRun != nil && isRun[i/8]&(1<<(i%8)) > 0:
+			c, err = pr.readRun(cards[i])
+		case cards[i] <= arrayMaxCardinality:
+			c, err = pr.readArray(cards[i])
+		default:
+			c, err = pr.readBitmap16(cards[i])
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading container %d", i)
+		}
+		conts = append(conts, keyedContainer{key: hi<<32 | uint64(keys[i])<<16, c: c})
+	}
+	return conts, nil
+}
+
+func (pr *portableReader) readRun(card int) ([]uint16, error) {
+	b, err := pr.read(2)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	if b, err = pr.read(4 * n); err != nil {
+		return nil, err
+	}
+	pairs := make([]uint16, 2*n)
+	for i := 0; i < n; i++ {
+		start := binary.LittleEndian.Uint16(b[4*i:])
+		length := binary.LittleEndian.Uint16(b[4*i+2:])
+		if int(start)+int(length) > 0xFFFF {
+			return nil, errors.Errorf("run %d overflows the container", i)
+		}
+		if i > 0 && start <= pairs[2*i-1] {
+			return nil, errors.Errorf("runs are not sorted at index %d", i)
+		}
+		pairs[2*i], pairs[2*i+1] = start, start+length
+	}
+	if num := runsCardinality(pairs); num != card {
+		return nil, errors.Errorf("cardinality %d doesn't match runs %d", card, num)
+	}
+	return runContainerFrom(pairs), nil
+}
+
+func (pr *portableReader) readArray(card int) ([]uint16, error) {
+	b, err := pr.read(2 * card)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]uint16, card)
+	for i := range vals {
+		vals[i] = binary.LittleEndian.Uint16(b[2*i:])
+		if i > 0 && vals[i] <= vals[i-1] {
+			return nil, errors.Errorf("array is not sorted at index %d", i)
+		}
+	}
+	return arrayContainerFrom(vals), nil
+}
+
+// readBitmap16 reads a bitmap container, holding 16 bits.
+func (pr *portableReader) readBitmap16(card int) ([]uint16, error) {
+	b, err := pr.read(portableBitmapSize)
+	if err != nil {
+		return nil, err
+	}
+	c := bitmap(make([]uint16, maxContainerSize))
+	c[indexSize] = maxContainerSize
+	c[indexType] = typeBitmap
+	words := c[startIdx:]
+	for i := 0; i < len(words); i += 4 {
+		x := binary.LittleEndian.Uint64(b[2*i:])
+		for j := 0; j < 4; j++ {
+			words[i+j] = bits.Reverse16(uint16(x >> (16 * j)))
+		}
+	}
+	if num := c.cardinality(); num != card {
+		return nil, errors.Errorf("cardinality %d doesn't match bitmap contents %d", card, num)
+	}
+	setCardinality(c, card)
+	return c, nil
+}
+
+func appendUint16(b []byte, x uint16) []byte {
+	return append(b, byte(x), byte(x>>8))
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(x)), uint32(x>>32))
+}
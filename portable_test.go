@@ -0,0 +1,162 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+// portableBitmaps returns bitmaps with values in [0, max), covering all the container types.
+func portableBitmaps(max int64) []*Bitmap {
+	sparse := NewBitmap()
+	for i := 0; i < 1000; i++ {
+		sparse.Set(uint64(rand.Int63n(max)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 1e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	// Leave an empty container behind.
+	dense.Set(uint64(max - 1))
+	dense.Remove(uint64(max - 1))
+
+	mixed := clustered(100, max)
+	mixed.AddRange(0, 1<<16)
+	mixed.Or(*sparse)
+
+	return []*Bitmap{NewBitmap(), sparse, dense, runify(dense), mixed, runify(sparse)}
+}
+
+func TestPortable(t *testing.T) {
+	for i, a := range portableBitmaps(1 << 32) {
+		buf, err := a.ToPortable()
+		require.NoError(t, err)
+
+		rb := roaring.New()
+		_, err = rb.FromBuffer(buf)
+		require.NoError(t, err, "bitmap %d", i)
+		require.Equal(t, a.GetCardinality(), int(rb.GetCardinality()))
+		vals := a.ToArray()
+		rb.Iterate(func(x uint32) bool {
+			require.Equal(t, vals[0], uint64(x))
+			vals = vals[1:]
+			return true
+		})
+
+		// Read it back, with and without run containers on the roaring side.
+		for _, runOptimize := range []bool{false, true} {
+			if runOptimize {
+				rb.RunOptimize()
+			}
+			var out bytes.Buffer
+			_, err = rb.WriteTo(&out)
+			require.NoError(t, err)
+
+			b, err := FromPortable(out.Bytes())
+			require.NoError(t, err)
+			require.True(t, a.Equals(b), "bitmap %d", i)
+			require.NoError(t, validate(b.data))
+		}
+
+		b, err := FromPortable(buf)
+		require.NoError(t, err)
+		require.True(t, a.Equals(b))
+	}
+
+	a := NewBitmap()
+	a.Set(1 << 32)
+	_, err := a.ToPortable()
+	require.Error(t, err)
+}
+
+func TestPortable64(t *testing.T) {
+	for i, a := range portableBitmaps(1 << 40) {
+		buf := a.ToPortable64()
+
+		rb := roaring64.New()
+		_, err := rb.ReadFrom(bytes.NewReader(buf))
+		require.NoError(t, err, "bitmap %d", i)
+		require.Equal(t, a.GetCardinality(), int(rb.GetCardinality()))
+		require.Equal(t, a.ToArray(), append([]uint64{}, rb.ToArray()...))
+
+		rb.RunOptimize()
+		var out bytes.Buffer
+		_, err = rb.WriteTo(&out)
+		require.NoError(t, err)
+		b, err := FromPortable64(out.Bytes())
+		require.NoError(t, err)
+		require.True(t, a.Equals(b), "bitmap %d", i)
+
+		b, err = FromPortable64(buf)
+		require.NoError(t, err)
+		require.True(t, a.Equals(b))
+	}
+}
+
+func TestPortableStream(t *testing.T) {
+	a := clustered(100, 1<<20)
+	b := clustered(100, 1<<40)
+
+	var buf bytes.Buffer
+	n, err := a.WritePortableTo(&buf)
+	require.NoError(t, err)
+	m, err := b.WritePortable64To(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int(n+m), buf.Len())
+
+	// The readers shouldn't consume more than a bitmap.
+	ra, err := ReadPortableFrom(&buf)
+	require.NoError(t, err)
+	require.True(t, a.Equals(ra))
+	rb, err := ReadPortable64From(&buf)
+	require.NoError(t, err)
+	require.True(t, b.Equals(rb))
+	require.Equal(t, 0, buf.Len())
+}
+
+func TestPortableInvalid(t *testing.T) {
+	a := clustered(100, 1<<20)
+	a.Or(*runify(clustered(100, 1<<20)))
+	buf, err := a.ToPortable()
+	require.NoError(t, err)
+
+	_, err = FromPortable(nil)
+	require.Error(t, err)
+	_, err = FromPortable([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	require.Error(t, err)
+	for _, sz := range []int{4, 10, len(buf) / 2, len(buf) - 1} {
+		_, err = FromPortable(buf[:sz])
+		require.Error(t, err, "size %d", sz)
+	}
+
+	// Corrupt the cardinality of the first container, which follows the cookie and its key.
+	buf, err = clustered(100, 1<<20).ToPortable()
+	require.NoError(t, err)
+	cp := append([]byte{}, buf...)
+	cp[8+2]++
+	_, err = FromPortable(cp)
+	require.Error(t, err)
+
+	_, err = FromPortable64(buf)
+	require.Error(t, err)
+}
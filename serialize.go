@@ -0,0 +1,569 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A serialized bitmap can optionally start with a header, which describes the format of the
+// buffer following it. Buffers without the header are treated as legacy buffers, which start
+// directly with the key node.
+//
+// The header is headerSize bytes long, so that the buffer following it stays 8-byte aligned. All
+// the fields in the header are stored in little-endian byte order.
+// [0:4]  magic
+// [4]    format version
+// [5]    flags
+// [6:8]  set of container types present in the buffer. Bit i is set for container type i.
+// [8:16] length of the buffer following the header in bytes.
+//
+// The 4th byte (version) is never zero. A legacy buffer starts with the node size as uint64, which
+// would need to be at least 2^32 to look like a header.
+//
+// If flagChecksum is set, the buffer is followed by a trailer of trailerSize bytes, holding the
+// CRC32C (Castagnoli) checksum of the buffer in little-endian byte order.
+//
+// The serialized format is in little-endian byte order, including the buffers without a header
+// returned by ToBuffer. On little-endian hosts, which are the vast majority, the buffer is written
+// and read in place without any conversion. On big-endian hosts, it is converted while writing and
+// reading it, by copying it. flagBigEndian marks a buffer following the header in big-endian byte
+// order. It is never set by the writers, but such buffers are converted while reading them too.
+//
+// Legacy buffers don't declare their byte order. Besides the little-endian ones, they can be in the
+// byte order of the host which wrote them, from before the byte order was fixed. The node size at
+// the start of the buffer tells them apart, see otherByteOrder.
+
+const (
+	headerSize    = 16
+	formatVersion = 1
+
+	// flagBigEndian is set if the buffer following the header is in big-endian byte order.
+	flagBigEndian = 0x01
+	// flagChecksum is set if the buffer is followed by a checksum trailer.
+	flagChecksum = 0x02
+
+	trailerSize = 4
+
+	// knownContainerTypes is the set of container types this version can read.
+	knownContainerTypes = 1<<typeArray | 1<<typeBitmap | 1<<typeRun
+)
+
+var headerMagic = []byte("SROR")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type header struct {
+	version uint8
+	flags   uint8
+	types   uint16
+	length  uint64
+
+	// checksum is read from the trailer, if flagChecksum is set.
+	checksum uint32
+}
+
+func (h header) encode(dst []byte) {
+	copy(dst[0:4], headerMagic)
+	dst[4] = h.version
+	dst[5] = h.flags
+	binary.LittleEndian.PutUint16(dst[6:8], h.types)
+	binary.LittleEndian.PutUint64(dst[8:16], h.length)
+}
+
+// hasHeader returns true if the buffer starts with a header.
+func hasHeader(data []byte) bool {
+	return len(data) >= headerSize && bytes.Equal(data[:4], headerMagic) && data[4] != 0
+}
+
+// decodeHeader parses the header at the start of the buffer, which must have a header. It returns
+// an error if the header describes a buffer we can't read.
+func decodeHeader(data []byte) (header, error) {
+	var h header
+	h.version = data[4]
+	h.flags = data[5]
+	h.types = binary.LittleEndian.Uint16(data[6:8])
+	h.length = binary.LittleEndian.Uint64(data[8:16])
+
+	if h.version > formatVersion {
+		return h, errors.Errorf("unsupported format version: %d", h.version)
+	}
+	if unknown := h.types &^ knownContainerTypes; unknown > 0 {
+		return h, errors.Errorf("unsupported container types: %#x", unknown)
+	}
+	return h, nil
+}
+
+// otherByteOrder returns true if the buffer following the header is in the other byte order than
+// the host's. Legacy buffers don't have a header, so their byte order is found from the node size
+// at their start, which is smaller than the buffer. Read in the wrong byte order, it would be at
+// least 2^48.
+func otherByteOrder(h header, body []byte) bool {
+	if h.version > 0 {
+		return (h.flags&flagBigEndian > 0) != hostBigEndian
+	}
+	return len(body) >= 8 && hostByteOrder().Uint64(body) > uint64(len(body)/2)
+}
+
+// hostByteOrder returns the byte order of the host, and otherOrder the other one.
+func hostByteOrder() binary.ByteOrder {
+	if hostBigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func otherOrder() binary.ByteOrder {
+	if hostBigEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// toLittleEndian returns the buffer of data in little-endian byte order. On little-endian hosts, it
+// refers to data without copying it. On big-endian hosts, it is a converted copy.
+func toLittleEndian(data []uint16) []byte {
+	if hostBigEndian {
+		return swapByteOrder(toByteSlice(data), binary.BigEndian)
+	}
+	return toByteSlice(data)
+}
+
+// littleEndianCopy returns a copy of the buffer of data in little-endian byte order.
+func littleEndianCopy(data []uint16) []byte {
+	if hostBigEndian {
+		return swapByteOrder(toByteSlice(data), binary.BigEndian)
+	}
+	buf := AlignedBuffer(2 * len(data))
+	copy(buf, toByteSlice(data))
+	return buf
+}
+
+// toReadable returns the buffer following the header, such that it can be read in place. It must
+// be in the byte order of the host, and 8-byte aligned, because the key node is read as uint64s.
+// Otherwise, the buffer is copied and converted, the returned header is updated accordingly, and
+// true is returned. The checksum isn't kept after the conversion, because it was computed over the
+// original buffer.
+func toReadable(h header, body []byte) (header, []byte, bool) {
+	if len(body) == 0 {
+		return h, body, false
+	}
+	if otherByteOrder(h, body) {
+		h.flags ^= flagBigEndian
+		h.flags &^= flagChecksum
+		return h, swapByteOrder(body, otherOrder()), true
+	}
+	if !isAligned(body) {
+		out := AlignedBuffer(len(body))
+		copy(out, body)
+		return h, out, true
+	}
+	return h, body, false
+}
+
+// swapByteOrder returns a copy of the buffer, which is in the given byte order, with the byte
+// order of its integers swapped. The key node consists of uint64s, and the containers of uint16s.
+func swapByteOrder(body []byte, order binary.ByteOrder) []byte {
+	out := AlignedBuffer(len(body))
+	copy(out, body)
+
+	var nodeBytes int
+	if len(out) >= 8 {
+		// The node size is in uint16s.
+		if sz := order.Uint64(out); sz < uint64(len(out)/2) {
+			nodeBytes = int(sz) * 2
+		} else {
+			nodeBytes = len(out)
+		}
+		nodeBytes -= nodeBytes % 8
+	}
+	for i := 0; i < nodeBytes; i += 8 {
+		w := out[i : i+8]
+		w[0], w[1], w[2], w[3], w[4], w[5], w[6], w[7] = w[7], w[6], w[5], w[4], w[3], w[2], w[1], w[0]
+	}
+	for i := nodeBytes; i+1 < len(out); i += 2 {
+		out[i], out[i+1] = out[i+1], out[i]
+	}
+	return out
+}
+
+// readHeader parses the header at the start of the buffer, and returns it along with the buffer
+// following it. If the buffer doesn't have a header, an empty header and the whole buffer is
+// returned.
+func readHeader(data []byte) (header, []byte, error) {
+	if !hasHeader(data) {
+		return header{}, data, nil
+	}
+	h, err := decodeHeader(data)
+	if err != nil {
+		return h, nil, err
+	}
+	avail := uint64(len(data) - headerSize)
+	if h.flags&flagChecksum > 0 {
+		if avail < trailerSize {
+			return h, nil, errors.Errorf("buffer is too small to hold the checksum")
+		}
+		avail -= trailerSize
+	}
+	if h.length > avail {
+		return h, nil, errors.Errorf("buffer length %d exceeds the available %d bytes",
+			h.length, avail)
+	}
+	if h.flags&flagChecksum > 0 {
+		end := headerSize + h.length
+		h.checksum = binary.LittleEndian.Uint32(data[end : end+trailerSize])
+	}
+	return h, data[headerSize : headerSize+h.length], nil
+}
+
+// containerTypes returns the set of container types used in the bitmap.
+func (ra *Bitmap) containerTypes() uint16 {
+	var types uint16
+	for i := 0; i < ra.keys.numKeys(); i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		types |= 1 << c[indexType]
+	}
+	return types
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// ToBufferWithHeader returns a copy of the bitmap's buffer, prefixed with a header describing the
+// format version, the byte order and the container types used. FromBuffer recognizes this header,
+// and would refuse to read a buffer it doesn't understand, instead of silently misreading it.
+func (ra *Bitmap) ToBufferWithHeader() []byte {
+	return ra.toBufferWithHeader(0)
+}
+
+// ToBufferWithChecksum is the same as ToBufferWithHeader, but it also appends a CRC32C checksum of
+// the buffer. The checksum is verified by FromBufferVerified and Verify.
+func (ra *Bitmap) ToBufferWithChecksum() []byte {
+	return ra.toBufferWithHeader(flagChecksum)
+}
+
+// newHeader returns the header for the given buffer of the bitmap.
+func (ra *Bitmap) newHeader(body []byte, flags uint8) header {
+	h := header{
+		version: formatVersion,
+		flags:   flags,
+		types:   ra.containerTypes(),
+		length:  uint64(len(body)),
+	}
+	return h
+}
+
+func (ra *Bitmap) toBufferWithHeader(flags uint8) []byte {
+	var body []byte
+	if !ra.IsEmpty() {
+		body = toLittleEndian(ra.data)
+	}
+	h := ra.newHeader(body, flags)
+
+	sz := headerSize + len(body)
+	if h.flags&flagChecksum > 0 {
+		sz += trailerSize
+	}
+	buf := make([]byte, sz)
+	h.encode(buf)
+	copy(buf[headerSize:], body)
+	if h.flags&flagChecksum > 0 {
+		binary.LittleEndian.PutUint32(buf[headerSize+len(body):], checksum(body))
+	}
+	return buf
+}
+
+// FromBufferVerified returns a bitmap corresponding to the buffer written by
+// ToBufferWithChecksum, after verifying the checksum of the buffer. Like FromBuffer, it doesn't
+// copy the buffer.
+func FromBufferVerified(data []byte) (*Bitmap, error) {
+	h, body, err := readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.flags&flagChecksum == 0 {
+		return nil, errors.Errorf("buffer doesn't have a checksum")
+	}
+	if got := checksum(body); got != h.checksum {
+		return nil, errors.Errorf("checksum mismatch. Expected: %#x, got: %#x", h.checksum, got)
+	}
+	return fromBufferWithHeader(h, body), nil
+}
+
+// fromBufferWithHeader returns the bitmap for the buffer following the given header.
+func fromBufferWithHeader(h header, body []byte) *Bitmap {
+	h, body, copied := toReadable(h, body)
+	ra := fromBuffer(body)
+	if h.flags&flagChecksum > 0 && len(body) > 0 {
+		ra.checksum = h.checksum
+		ra.hasChecksum = true
+	}
+	ra.copied = copied
+	return ra
+}
+
+// BufferCopied returns true if the bitmap was created from a buffer, which had to be copied
+// because it wasn't 8-byte aligned or was in the other byte order. Buffers allocated using
+// AlignedBuffer don't need to be copied.
+func (ra *Bitmap) BufferCopied() bool {
+	return ra.copied
+}
+
+// Verify checks that the buffer underlying the bitmap is well formed. If the bitmap was created
+// from a buffer with a checksum, the checksum is verified as well. Note that modifying such a
+// bitmap would invalidate the checksum.
+func (ra *Bitmap) Verify() error {
+	if err := validate(ra.data); err != nil {
+		return err
+	}
+	if !ra.hasChecksum {
+		return nil
+	}
+	if got := checksum(toByteSlice(ra.data)); got != ra.checksum {
+		return errors.Errorf("checksum mismatch. Expected: %#x, got: %#x", ra.checksum, got)
+	}
+	return nil
+}
+
+// FromBufferSafe is the same as FromBuffer, but it validates the buffer first. It returns an error
+// if the buffer is truncated or corrupt, instead of panicking while reading it. If the buffer has
+// a checksum, it is verified as well. The validation reads the entire buffer, so it is slower than
+// FromBuffer.
+func FromBufferSafe(data []byte) (*Bitmap, error) {
+	h, body, err := readHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.flags&flagChecksum > 0 {
+		if got := checksum(body); got != h.checksum {
+			return nil, errors.Errorf("checksum mismatch. Expected: %#x, got: %#x", h.checksum, got)
+		}
+	}
+	h, body, copied := toReadable(h, body)
+	if len(body) == 0 {
+		return NewBitmap(), nil
+	}
+	if len(body)%2 != 0 {
+		return nil, errors.Errorf("buffer length %d is not a multiple of 2", len(body))
+	}
+	if len(body) < 8*indexNodeStart {
+		return nil, errors.Errorf("buffer length %d is too small", len(body))
+	}
+	if err := validate(toUint16Slice(body)); err != nil {
+		return nil, err
+	}
+	ra := fromBufferWithHeader(h, body)
+	ra.copied = copied
+	return ra, nil
+}
+
+// validate checks that data is a well formed bitmap buffer. It checks the key node, and every
+// container referred by it.
+func validate(data []uint16) error {
+	if len(data) < 4*indexNodeStart {
+		return errors.Errorf("buffer of %d uint16s can't hold the key node", len(data))
+	}
+	// The node size needn't be a multiple of 4, because setKey caps the growth of the node at
+	// math.MaxUint16 uint16s.
+	sz := toUint64Slice(data[:4])[indexNodeSize]
+	if sz < uint64(4*indexNodeStart) || sz > uint64(len(data)) {
+		return errors.Errorf("invalid key node size: %d, buffer size: %d", sz, len(data))
+	}
+	keys := node(toUint64Slice(data[:sz]))
+
+	n := keys.numKeys()
+	if n < 1 || n >= keys.maxKeys() {
+		return errors.Errorf("invalid number of keys: %d, max keys: %d", n, keys.maxKeys())
+	}
+	for i := 0; i < n; i++ {
+		key := keys.key(i)
+		if key&^mask != 0 {
+			return errors.Errorf("key %#x at index %d has its lower 16 bits set", key, i)
+		}
+		if i > 0 && key <= keys.key(i-1) {
+			return errors.Errorf("keys are not sorted at index %d", i)
+		}
+		off := keys.val(i)
+		if off < sz || off >= uint64(len(data)) {
+			return errors.Errorf("container offset %d for key %#x is out of bounds", off, key)
+		}
+		csz := uint64(data[off])
+		if csz < uint64(startIdx) || off+csz > uint64(len(data)) {
+			return errors.Errorf("invalid size %d of container at offset %d", csz, off)
+		}
+		if err := validateContainer(data[off : off+csz]); err != nil {
+			return errors.Wrapf(err, "container for key %#x", key)
+		}
+	}
+	return nil
+}
+
+func validateContainer(c []uint16) error {
+	card := getCardinality(c)
+	switch c[indexType] {
+	case typeArray:
+		if card > len(c)-int(startIdx) {
+			return errors.Errorf("cardinality %d exceeds array size %d", card, len(c))
+		}
+		vals := array(c).all()
+		for i := 1; i < len(vals); i++ {
+			if vals[i] <= vals[i-1] {
+				return errors.Errorf("array is not sorted at index %d", i)
+			}
+		}
+	case typeBitmap:
+		if len(c) != maxContainerSize {
+			return errors.Errorf("invalid bitmap size: %d", len(c))
+		}
+		if num := bitmap(c).cardinality(); num != card {
+			return errors.Errorf("cardinality %d doesn't match bitmap contents %d", card, num)
+		}
+	case typeRun:
+		if len(c) <= int(startIdx) {
+			return errors.Errorf("invalid run container size: %d", len(c))
+		}
+		r := run(c)
+		if runOffset(r.numRuns()) > len(c) {
+			return errors.Errorf("%d runs exceed run container size %d", r.numRuns(), len(c))
+		}
+		for i := 0; i < r.numRuns(); i++ {
+			if r.start(i) > r.last(i) {
+				return errors.Errorf("run %d is invalid: [%d, %d]", i, r.start(i), r.last(i))
+			}
+			if i > 0 && r.start(i) <= r.last(i-1) {
+				return errors.Errorf("runs are not sorted at index %d", i)
+			}
+		}
+		if num := r.cardinality(); num != card {
+			return errors.Errorf("cardinality %d doesn't match runs %d", card, num)
+		}
+	default:
+		return errors.Errorf("unknown container type: %d", c[indexType])
+	}
+	return nil
+}
+
+// WriteTo writes the bitmap to w in the format of ToBufferWithHeader, without copying the buffer.
+// It implements io.WriterTo.
+func (ra *Bitmap) WriteTo(w io.Writer) (int64, error) {
+	var data []uint16
+	if !ra.IsEmpty() {
+		data = ra.data
+	}
+	return ra.writeTo(w, data)
+}
+
+// WriteCompactTo is the same as WriteTo, but it leaves out the unused space in the key node and the
+// containers, along with the empty containers. The output is smaller, but the buffer needs to be
+// copied to produce it.
+func (ra *Bitmap) WriteCompactTo(w io.Writer) (int64, error) {
+	var data []uint16
+	if !ra.IsEmpty() {
+		data = ra.rebuild(compactContainer)
+	}
+	return ra.writeTo(w, data)
+}
+
+func (ra *Bitmap) writeTo(w io.Writer, data []uint16) (int64, error) {
+	var body []byte
+	if len(data) > 0 {
+		body = toLittleEndian(data)
+	}
+	hdr := make([]byte, headerSize)
+	ra.newHeader(body, 0).encode(hdr)
+
+	n, err := w.Write(hdr)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(body)
+	return int64(n + m), err
+}
+
+// ReadFrom reads a bitmap written by WriteTo from r, and replaces the contents of the bitmap with
+// it. The bitmap is validated like FromBufferSafe does. It doesn't read beyond the end of the
+// bitmap. It implements io.ReaderFrom.
+func (ra *Bitmap) ReadFrom(r io.Reader) (int64, error) {
+	if ra.readOnly {
+		return 0, ErrReadOnly
+	}
+	hdr := make([]byte, headerSize)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return int64(n), errors.Wrap(err, "while reading header")
+	}
+	if !hasHeader(hdr) {
+		return int64(n), errors.Errorf("buffer doesn't have a header")
+	}
+	h, err := decodeHeader(hdr)
+	if err != nil {
+		return int64(n), err
+	}
+	sz := headerSize + h.length
+	if h.flags&flagChecksum > 0 {
+		sz += trailerSize
+	}
+	if h.length%2 != 0 || sz > math.MaxInt32 {
+		return int64(n), errors.Errorf("invalid buffer length: %d", h.length)
+	}
+
+	buf := AlignedBuffer(int(sz))
+	copy(buf, hdr)
+	m, err := io.ReadFull(r, buf[headerSize:])
+	if err != nil {
+		return int64(n + m), errors.Wrap(err, "while reading buffer")
+	}
+	bm, err := FromBufferSafe(buf)
+	if err != nil {
+		return int64(n + m), err
+	}
+	*ra = *bm
+	return int64(n + m), nil
+}
+
+// MarshalBinary returns the bitmap in the format of ToBufferWithHeader. It implements
+// encoding.BinaryMarshaler.
+func (ra *Bitmap) MarshalBinary() ([]byte, error) {
+	return ra.ToBufferWithHeader(), nil
+}
+
+// UnmarshalBinary replaces the contents of the bitmap with a copy of the given buffer, after
+// validating it like FromBufferSafe does. It implements encoding.BinaryUnmarshaler.
+func (ra *Bitmap) UnmarshalBinary(data []byte) error {
+	if ra.readOnly {
+		return ErrReadOnly
+	}
+	if len(data) == 0 {
+		*ra = *NewBitmap()
+		return nil
+	}
+	buf := AlignedBuffer(len(data))
+	copy(buf, data)
+	bm, err := FromBufferSafe(buf)
+	if err != nil {
+		return err
+	}
+	*ra = *bm
+	return nil
+}
@@ -0,0 +1,584 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferWithHeader(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+	a.Set(1 << 30)
+
+	buf := a.ToBufferWithHeader()
+	require.True(t, hasHeader(buf))
+	require.Equal(t, []byte("SROR"), buf[:4])
+	require.Equal(t, uint8(formatVersion), buf[4])
+	require.Equal(t, uint16(1<<typeArray|1<<typeBitmap|1<<typeRun),
+		binary.LittleEndian.Uint16(buf[6:8]))
+	require.Equal(t, uint64(len(buf)-headerSize), binary.LittleEndian.Uint64(buf[8:16]))
+
+	b := FromBuffer(buf)
+	require.True(t, a.Equals(b))
+	b = FromBufferWithCopy(buf)
+	require.True(t, a.Equals(b))
+
+	// Legacy buffers should still be readable.
+	require.False(t, hasHeader(a.ToBuffer()))
+	require.True(t, a.Equals(FromBuffer(a.ToBuffer())))
+
+	// Empty bitmaps.
+	buf = NewBitmap().ToBufferWithHeader()
+	require.Equal(t, headerSize, len(buf))
+	require.True(t, FromBuffer(buf).IsEmpty())
+}
+
+func TestBufferWithHeaderInvalid(t *testing.T) {
+	a := NewBitmap()
+	a.Set(1)
+	corrupt := func(fn func(buf []byte)) []byte {
+		buf := a.ToBufferWithHeader()
+		fn(buf)
+		return buf
+	}
+
+	tests := map[string][]byte{
+		"version": corrupt(func(buf []byte) { buf[4] = formatVersion + 1 }),
+		"types":   corrupt(func(buf []byte) { buf[6] |= 1 << 7 }),
+		"length":  corrupt(func(buf []byte) { binary.LittleEndian.PutUint64(buf[8:], 1<<20) }),
+	}
+	for name, buf := range tests {
+		_, _, err := readHeader(buf)
+		require.Errorf(t, err, "case: %s", name)
+		require.Panicsf(t, func() { FromBuffer(buf) }, "case: %s", name)
+		require.Panicsf(t, func() { FromBufferWithCopy(buf) }, "case: %s", name)
+	}
+}
+
+func TestFromBufferSafe(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+	for i := uint64(0); i < 100; i++ {
+		a.Set(i << 30)
+		a.Set(i<<30 + 10)
+	}
+
+	for _, buf := range [][]byte{a.ToBuffer(), a.ToBufferWithHeader()} {
+		b, err := FromBufferSafe(buf)
+		require.NoError(t, err)
+		require.True(t, a.Equals(b))
+	}
+
+	b, err := FromBufferSafe(nil)
+	require.NoError(t, err)
+	require.True(t, b.IsEmpty())
+
+	src := a.ToBufferWithCopy()
+	corrupt := func(fn func(du []uint16, keys node)) []byte {
+		buf := make([]byte, len(src))
+		copy(buf, src)
+		du := toUint16Slice(buf)
+		x := toUint64Slice(du[:4])[indexNodeSize]
+		fn(du, toUint64Slice(du[:x]))
+		return buf
+	}
+	offsetOf := func(keys node, typ uint16, du []uint16) uint64 {
+		for i := 0; i < keys.numKeys(); i++ {
+			if off := keys.val(i); du[off+uint64(indexType)] == typ {
+				return off
+			}
+		}
+		panic("container not found")
+	}
+
+	tests := map[string][]byte{
+		"odd length":     src[:len(src)-1],
+		"truncated":      src[:len(src)/2],
+		"too small":      src[:6],
+		"node size":      corrupt(func(du []uint16, keys node) { keys.setNodeSize(len(du) + 4) }),
+		"num keys":       corrupt(func(du []uint16, keys node) { keys.setNumKeys(keys.maxKeys()) }),
+		"unsorted keys":  corrupt(func(du []uint16, keys node) { keys.setAt(keyOffset(2), 1<<40) }),
+		"key lower bits": corrupt(func(du []uint16, keys node) { keys.setAt(keyOffset(1), 1<<16+1) }),
+		"offset":         corrupt(func(du []uint16, keys node) { keys.setAt(valOffset(1), uint64(len(du))) }),
+		"offset in node": corrupt(func(du []uint16, keys node) { keys.setAt(valOffset(1), 8) }),
+		"container size": corrupt(func(du []uint16, keys node) {
+			off := keys.val(keys.numKeys() - 1)
+			du[off] = uint16(uint64(len(du)) - off + 1)
+		}),
+		"container type": corrupt(func(du []uint16, keys node) {
+			du[keys.val(0)+uint64(indexType)] = 0x7
+		}),
+		"array unsorted": corrupt(func(du []uint16, keys node) {
+			off := offsetOf(keys, typeArray, du)
+			du[off+uint64(startIdx)] = 0xFFFF
+		}),
+		"array cardinality": corrupt(func(du []uint16, keys node) {
+			off := offsetOf(keys, typeArray, du)
+			setCardinality(du[off:], int(du[off]))
+		}),
+		"bitmap cardinality": corrupt(func(du []uint16, keys node) {
+			off := offsetOf(keys, typeBitmap, du)
+			du[off+uint64(startIdx)] ^= 0x1
+		}),
+		"run cardinality": corrupt(func(du []uint16, keys node) {
+			off := offsetOf(keys, typeRun, du)
+			du[off+uint64(runOffset(0))+1]--
+		}),
+		"num runs": corrupt(func(du []uint16, keys node) {
+			off := offsetOf(keys, typeRun, du)
+			du[off+uint64(startIdx)] = 0xFFFF
+		}),
+	}
+	for name, buf := range tests {
+		_, err := FromBufferSafe(buf)
+		require.Errorf(t, err, "case: %s", name)
+	}
+
+	// Random corruptions should never cause a panic.
+	for i := 0; i < 1000; i++ {
+		buf := corrupt(func(du []uint16, keys node) {
+			for j := 0; j < 1+rand.Intn(4); j++ {
+				idx := rand.Intn(len(du))
+				if rand.Intn(2) == 0 {
+					// Corrupt the key node more often.
+					idx = rand.Intn(4 * len(keys))
+				}
+				du[idx] = uint16(rand.Intn(1 << 16))
+			}
+		})
+		if b, err := FromBufferSafe(buf); err == nil {
+			b.ToArray()
+			b.GetCardinality()
+		}
+	}
+}
+
+// TestValidateSetOps checks that the results of the set operations over all the combinations of
+// container types are valid buffers.
+func TestValidateSetOps(t *testing.T) {
+	sparse := NewBitmap()
+	for i := 0; i < 3000; i++ {
+		sparse.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	dense := NewBitmap()
+	for i := 0; i < 2e5; i++ {
+		dense.Set(uint64(rand.Int63n(1 << 20)))
+	}
+	ranges := NewBitmap()
+	for i := uint64(0); i < 1<<20; i += 1 << 14 {
+		ranges.AddRange(i, i+uint64(rand.Intn(1<<14)))
+	}
+	bms := []*Bitmap{NewBitmap(), sparse, dense, ranges, runify(sparse), runify(dense),
+		clustered(200, 1<<20)}
+
+	check := func(res *Bitmap, op string, i, j int) {
+		require.NoError(t, validate(res.data), "%s of bitmaps %d and %d", op, i, j)
+		_, err := FromBufferSafe(res.ToBufferWithCopy())
+		require.NoError(t, err, "%s of bitmaps %d and %d", op, i, j)
+	}
+	for i, a := range bms {
+		for j, b := range bms {
+			aClone, bClone := a.Clone(), b.Clone()
+			check(And(a, b), "And", i, j)
+			check(Or(a, b), "Or", i, j)
+			check(AndNot(a, b), "AndNot", i, j)
+			check(Xor(a, b), "Xor", i, j)
+			// FastAnd modifies its first bitmap.
+			check(FastAnd(a.Clone(), b), "FastAnd", i, j)
+			fo := FastOr(*a.Clone(), *b)
+			check(&fo, "FastOr", i, j)
+
+			c := a.Clone()
+			c.And(b)
+			check(c, "in-place And", i, j)
+			c = a.Clone()
+			c.Or(*b)
+			check(c, "in-place Or", i, j)
+			c = a.Clone()
+			c.AndNot(b)
+			check(c, "in-place AndNot", i, j)
+			c = a.Clone()
+			c.Xor(b)
+			check(c, "in-place Xor", i, j)
+
+			// The operands must be left unchanged.
+			require.True(t, aClone.Equals(a), "bitmap %d changed with %d", i, j)
+			require.True(t, bClone.Equals(b), "bitmap %d changed with %d", j, i)
+		}
+	}
+}
+
+func TestBufferWithChecksum(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+
+	buf := a.ToBufferWithChecksum()
+	require.Equal(t, uint8(flagChecksum), buf[5]&flagChecksum)
+	require.Equal(t, uint64(len(buf)-headerSize-trailerSize),
+		binary.LittleEndian.Uint64(buf[8:16]))
+
+	b, err := FromBufferVerified(buf)
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+	require.NoError(t, b.Verify())
+
+	// The unverified readers should skip the trailer.
+	require.True(t, a.Equals(FromBuffer(buf)))
+	require.True(t, a.Equals(FromBufferWithCopy(buf)))
+	b, err = FromBufferSafe(buf)
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+
+	// Buffers without a checksum can't be verified.
+	_, err = FromBufferVerified(a.ToBufferWithHeader())
+	require.Error(t, err)
+	require.NoError(t, FromBuffer(a.ToBuffer()).Verify())
+
+	// Flip a bit in the body and in the trailer.
+	for _, idx := range []int{headerSize + 100, len(buf) - 1} {
+		cp := append([]byte{}, buf...)
+		cp[idx] ^= 0x10
+		_, err = FromBufferVerified(cp)
+		require.Error(t, err)
+	}
+
+	// A bitmap read with FromBuffer should still detect the corruption on Verify.
+	cp := append([]byte{}, buf...)
+	b = FromBuffer(cp)
+	require.NoError(t, b.Verify())
+	cp[len(cp)-trailerSize-1] ^= 0x01
+	require.Error(t, b.Verify())
+
+	// Truncated trailer.
+	_, err = FromBufferVerified(buf[:len(buf)-1])
+	require.Error(t, err)
+
+	// Empty bitmaps.
+	buf = NewBitmap().ToBufferWithChecksum()
+	require.Equal(t, headerSize+trailerSize, len(buf))
+	b, err = FromBufferVerified(buf)
+	require.NoError(t, err)
+	require.True(t, b.IsEmpty())
+}
+
+func TestWriteTo(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+	for i := uint64(1); i < 100; i++ {
+		a.Set(i << 32)
+	}
+	// Leave some empty containers behind.
+	a.RemoveRange(1<<32, 10<<32)
+
+	var buf bytes.Buffer
+	n, err := a.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	require.Equal(t, a.ToBufferWithHeader(), buf.Bytes())
+
+	m, err := a.WriteCompactTo(&buf)
+	require.NoError(t, err)
+	require.Less(t, m, n)
+	_, err = NewBitmap().WriteTo(&buf)
+	require.NoError(t, err)
+
+	// The bitmaps should be read back one after the other.
+	b := NewBitmap()
+	k, err := b.ReadFrom(&buf)
+	require.NoError(t, err)
+	require.Equal(t, n, k)
+	require.True(t, a.Equals(b))
+
+	c := NewBitmap()
+	k, err = c.ReadFrom(&buf)
+	require.NoError(t, err)
+	require.Equal(t, m, k)
+	require.True(t, a.Equals(c))
+	require.NoError(t, validate(c.data))
+
+	// The read bitmaps own their buffers, so they can be modified.
+	c.Set(1 << 40)
+	c.Remove(1 << 20)
+	require.Equal(t, a.GetCardinality(), c.GetCardinality())
+
+	k, err = b.ReadFrom(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(headerSize), k)
+	require.True(t, b.IsEmpty())
+	require.Equal(t, 0, buf.Len())
+
+	// Checksums are verified.
+	cs := a.ToBufferWithChecksum()
+	_, err = b.ReadFrom(bytes.NewReader(cs))
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+	cs[headerSize+10] ^= 0x01
+	_, err = b.ReadFrom(bytes.NewReader(cs))
+	require.Error(t, err)
+
+	// Truncated streams and buffers without a header.
+	full := a.ToBufferWithHeader()
+	for _, sz := range []int{0, 10, headerSize, len(full) - 1} {
+		_, err = b.ReadFrom(bytes.NewReader(full[:sz]))
+		require.Error(t, err, "size %d", sz)
+	}
+	_, err = b.ReadFrom(bytes.NewReader(a.ToBuffer()))
+	require.Error(t, err)
+}
+
+func TestMarshalBinary(t *testing.T) {
+	var _ encoding.BinaryMarshaler = (*Bitmap)(nil)
+	var _ encoding.BinaryUnmarshaler = (*Bitmap)(nil)
+
+	a := NewBitmap()
+	for i := 0; i < 1e4; i++ {
+		a.Set(uint64(rand.Int63n(1 << 30)))
+	}
+	data, err := a.MarshalBinary()
+	require.NoError(t, err)
+
+	b := NewBitmap()
+	require.NoError(t, b.UnmarshalBinary(data))
+	require.True(t, a.Equals(b))
+
+	// The bitmap shouldn't refer to the given buffer.
+	for i := range data {
+		data[i] = 0
+	}
+	require.True(t, a.Equals(b))
+	b.Set(1 << 40)
+	require.True(t, b.Contains(1<<40))
+
+	// Legacy buffers, empty buffers and corrupt buffers.
+	require.NoError(t, b.UnmarshalBinary(a.ToBuffer()))
+	require.True(t, a.Equals(b))
+	require.NoError(t, b.UnmarshalBinary(nil))
+	require.True(t, b.IsEmpty())
+	require.Error(t, b.UnmarshalBinary([]byte{1, 2, 3}))
+}
+
+// encodeBody returns the buffer of the bitmap without a header, encoded explicitly in the given
+// byte order.
+func encodeBody(a *Bitmap, order binary.ByteOrder) []byte {
+	body := make([]byte, 2*len(a.data))
+	nodeSz := a.keys.size()
+	for i, w := range a.keys[:nodeSz/4] {
+		order.PutUint64(body[8*i:], w)
+	}
+	for i := 4 * (nodeSz / 4); i < len(a.data); i++ {
+		order.PutUint16(body[2*i:], a.data[i])
+	}
+	return body
+}
+
+// encodeWithHeader returns the buffer of the bitmap with a header, encoded explicitly in the given
+// byte order.
+func encodeWithHeader(a *Bitmap, order binary.ByteOrder, flags uint8) []byte {
+	body := encodeBody(a, order)
+	h := a.newHeader(body, flags)
+	if order == binary.BigEndian {
+		h.flags |= flagBigEndian
+	}
+	buf := make([]byte, headerSize+len(body), headerSize+len(body)+trailerSize)
+	h.encode(buf)
+	copy(buf[headerSize:], body)
+	if flags&flagChecksum > 0 {
+		buf = appendUint32(buf, checksum(body))
+	}
+	return buf
+}
+
+// toForeignOrder returns the buffer of the bitmap with a header, encoded explicitly in the byte
+// order which isn't the host's.
+func toForeignOrder(a *Bitmap, flags uint8) []byte {
+	return encodeWithHeader(a, otherOrder(), flags)
+}
+
+func TestBufferByteOrder(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+	for i := uint64(0); i < 100; i++ {
+		a.Set(i << 30)
+	}
+
+	buf := toForeignOrder(a, 0)
+	require.NotEqual(t, a.ToBufferWithHeader(), buf)
+	orig := append([]byte{}, buf...)
+
+	b := FromBuffer(buf)
+	require.True(t, a.Equals(b))
+	require.NoError(t, b.Verify())
+	require.Equal(t, orig, buf)
+	require.True(t, a.Equals(FromBufferWithCopy(buf)))
+
+	b, err := FromBufferSafe(buf)
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+
+	// The converted bitmap owns its buffer, so it can be modified.
+	b.Set(1 << 50)
+	b.Remove(3)
+	require.Equal(t, orig, buf)
+
+	c := NewBitmap()
+	_, err = c.ReadFrom(bytes.NewReader(buf))
+	require.NoError(t, err)
+	require.True(t, a.Equals(c))
+
+	// The checksum is verified over the original buffer.
+	buf = toForeignOrder(a, flagChecksum)
+	b, err = FromBufferVerified(buf)
+	require.NoError(t, err)
+	require.True(t, a.Equals(b))
+	require.NoError(t, b.Verify())
+	buf[headerSize+100] ^= 0x01
+	_, err = FromBufferVerified(buf)
+	require.Error(t, err)
+
+	require.Equal(t, encodeBody(a, hostByteOrder()),
+		swapByteOrder(toForeignOrder(a, 0)[headerSize:], otherOrder()))
+
+	// Empty bitmaps.
+	require.True(t, FromBuffer(toForeignOrder(NewBitmap(), 0)).IsEmpty())
+}
+
+func TestLittleEndianBuffer(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e4; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+
+	// The buffers are written in little-endian byte order on any host.
+	le := encodeBody(a, binary.LittleEndian)
+	require.Equal(t, le, a.ToBuffer())
+	require.Equal(t, le, a.ToBufferWithCopy())
+	buf := a.ToBufferWithHeader()
+	require.Equal(t, uint8(0), buf[5]&flagBigEndian)
+	require.Equal(t, le, buf[headerSize:])
+	require.Equal(t, encodeWithHeader(a, binary.LittleEndian, 0), buf)
+
+	var w bytes.Buffer
+	_, err := a.WriteTo(&w)
+	require.NoError(t, err)
+	require.Equal(t, le, w.Bytes()[headerSize:])
+}
+
+func TestLegacyBufferByteOrder(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e4; i += 3 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+
+	// Legacy buffers don't declare their byte order, so it's found from the node size. They can
+	// be in either byte order, with or without a header.
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		legacy := encodeBody(a, order)
+		require.Equal(t, order != hostByteOrder(), otherByteOrder(header{}, legacy))
+		b := FromBuffer(legacy)
+		require.True(t, a.Equals(b))
+		require.NoError(t, b.Verify())
+		require.Equal(t, order != hostByteOrder(), b.BufferCopied())
+		b, err := FromBufferSafe(legacy)
+		require.NoError(t, err)
+		require.True(t, a.Equals(b))
+
+		withHeader := encodeWithHeader(a, order, flagChecksum)
+		b, err = FromBufferVerified(withHeader)
+		require.NoError(t, err)
+		require.True(t, a.Equals(b))
+	}
+	require.False(t, otherByteOrder(header{}, nil))
+}
+
+func TestBufferAlignment(t *testing.T) {
+	a := NewBitmap()
+	for i := uint64(0); i < 1e5; i += 7 {
+		a.Set(i)
+	}
+	a.AddRange(1<<20, 1<<21)
+
+	for _, src := range [][]byte{a.ToBuffer(), a.ToBufferWithHeader(), a.ToBufferWithChecksum()} {
+		// Buffers allocated by AlignedBuffer are read in place.
+		buf := AlignedBuffer(len(src))
+		copy(buf, src)
+		require.True(t, isAligned(buf))
+		b := FromBuffer(buf)
+		require.True(t, a.Equals(b))
+		require.False(t, b.BufferCopied())
+		d := FromBufferWithCopy(buf)
+		require.True(t, a.Equals(d))
+		d.Set(1 << 40)
+		require.True(t, a.Equals(b))
+
+		// Unaligned buffers are copied.
+		buf = AlignedBuffer(len(src) + 1)[1:]
+		copy(buf, src)
+		require.False(t, isAligned(buf))
+		orig := append([]byte{}, buf...)
+
+		b = FromBuffer(buf)
+		require.True(t, a.Equals(b))
+		require.True(t, b.BufferCopied())
+		require.NoError(t, b.Verify())
+		require.True(t, a.Equals(FromBufferWithCopy(buf)))
+
+		d = FromBufferWithCopy(buf)
+		c, err := FromBufferSafe(buf)
+		require.NoError(t, err)
+		require.True(t, a.Equals(c))
+		require.True(t, c.BufferCopied())
+
+		// The bitmaps don't share the unaligned buffer.
+		b.Set(1 << 40)
+		c.Remove(7)
+		require.Equal(t, orig, buf)
+		for i := range buf {
+			buf[i] = 0
+		}
+		require.True(t, a.Equals(FromBuffer(orig)))
+		require.True(t, a.Equals(d))
+		require.Equal(t, a.GetCardinality()+1, b.GetCardinality())
+		require.Equal(t, a.GetCardinality()-1, c.GetCardinality())
+	}
+
+	require.True(t, FromBuffer(toForeignOrder(a, 0)).BufferCopied())
+	require.True(t, FromBuffer(AlignedBuffer(1)[1:]).IsEmpty())
+}
@@ -155,54 +155,6 @@ func exclusiveUnion2by2(set1 []uint16, set2 []uint16, buffer []uint16) int {
 	return pos
 }
 
-func union2by2Cardinality(set1 []uint16, set2 []uint16) int {
-	pos := 0
-	k1 := 0
-	k2 := 0
-	if 0 == len(set2) {
-		return len(set1)
-	}
-	if 0 == len(set1) {
-		return len(set2)
-	}
-	s1 := set1[k1]
-	s2 := set2[k2]
-	for {
-		if s1 < s2 {
-			pos++
-			k1++
-			if k1 >= len(set1) {
-				pos += len(set2) - k2
-				break
-			}
-			s1 = set1[k1]
-		} else if s1 == s2 {
-			pos++
-			k1++
-			k2++
-			if k1 >= len(set1) {
-				pos += len(set2) - k2
-				break
-			}
-			if k2 >= len(set2) {
-				pos += len(set1) - k1
-				break
-			}
-			s1 = set1[k1]
-			s2 = set2[k2]
-		} else { // if (set1[k1]>set2[k2])
-			pos++
-			k2++
-			if k2 >= len(set2) {
-				pos += len(set1) - k1
-				break
-			}
-			s2 = set2[k2]
-		}
-	}
-	return pos
-}
-
 func intersection2by2(
 	set1 []uint16,
 	set2 []uint16,
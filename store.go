@@ -0,0 +1,309 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A store holds many bitmaps, each identified by a uint64 id. It is laid out as:
+// [0:8]  file header: storeMagic, followed by the store version and 3 zero bytes.
+// The bitmaps, in the format written by WriteCompactTo. Each bitmap is padded with zeros to a
+// multiple of 8 bytes, so that every bitmap starts 8-byte aligned.
+// The index: an entry of storeEntrySize bytes for every bitmap, sorted by id.
+// The trailer of storeTrailerSize bytes: the offset of the index and the number of entries as
+// uint64s, the CRC32C checksum of the index as uint32, and storeMagic.
+//
+// An index entry holds the id, the offset and the length of the bitmap in bytes and its
+// cardinality, as uint64s. All the integers are in little-endian byte order.
+
+const (
+	storeVersion     = 1
+	storeHeaderSize  = 8
+	storeEntrySize   = 32
+	storeTrailerSize = 24
+)
+
+var storeMagic = []byte("SRST")
+
+// ErrNotFound is returned by StoreReader, if it doesn't have a bitmap with the given id.
+var ErrNotFound = errors.New("bitmap not found")
+
+type storeEntry struct {
+	id     uint64
+	offset uint64
+	length uint64
+	card   uint64
+}
+
+// StoreWriter writes bitmaps to a store. The bitmaps can be added in any order, and the index is
+// written by Close.
+type StoreWriter struct {
+	w       io.Writer
+	offset  uint64
+	entries []storeEntry
+	ids     map[uint64]struct{}
+	buf     bytes.Buffer
+	closed  bool
+}
+
+// NewStoreWriter returns a StoreWriter writing to w. The store is complete only after Close is
+// called. Bitmaps are written with a few calls to w each, so w should be buffered.
+func NewStoreWriter(w io.Writer) (*StoreWriter, error) {
+	sw := &StoreWriter{w: w, ids: make(map[uint64]struct{})}
+	hdr := make([]byte, storeHeaderSize)
+	copy(hdr, storeMagic)
+	hdr[4] = storeVersion
+	if err := sw.write(hdr); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *StoreWriter) write(b []byte) error {
+	n, err := sw.w.Write(b)
+	sw.offset += uint64(n)
+	return err
+}
+
+// Add writes the bitmap to the store under the given id. Every id can only be added once.
+func (sw *StoreWriter) Add(id uint64, bm *Bitmap) error {
+	if sw.closed {
+		return errors.Errorf("store writer is closed")
+	}
+	if _, has := sw.ids[id]; has {
+		return errors.Errorf("bitmap with id %d was already added", id)
+	}
+
+	sw.buf.Reset()
+	if _, err := bm.WriteCompactTo(&sw.buf); err != nil {
+		return err
+	}
+	e := storeEntry{
+		id:     id,
+		offset: sw.offset,
+		length: uint64(sw.buf.Len()),
+		card:   uint64(bm.GetCardinality()),
+	}
+	if pad := sw.buf.Len() % 8; pad > 0 {
+		sw.buf.Write(make([]byte, 8-pad))
+	}
+	if err := sw.write(sw.buf.Bytes()); err != nil {
+		return err
+	}
+	sw.entries = append(sw.entries, e)
+	sw.ids[id] = struct{}{}
+	return nil
+}
+
+// Close writes the index of the store. It doesn't close the underlying writer.
+func (sw *StoreWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+
+	sort.Slice(sw.entries, func(i, j int) bool {
+		return sw.entries[i].id < sw.entries[j].id
+	})
+	index := make([]byte, 0, storeEntrySize*len(sw.entries))
+	for _, e := range sw.entries {
+		index = appendUint64(index, e.id)
+		index = appendUint64(index, e.offset)
+		index = appendUint64(index, e.length)
+		index = appendUint64(index, e.card)
+	}
+
+	trailer := appendUint64(nil, sw.offset)
+	trailer = appendUint64(trailer, uint64(len(sw.entries)))
+	trailer = appendUint32(trailer, checksum(index))
+	trailer = append(trailer, storeMagic...)
+
+	if err := sw.write(index); err != nil {
+		return err
+	}
+	return sw.write(trailer)
+}
+
+// StoreReader reads the bitmaps from a store. The bitmaps returned by Get refer to the store's
+// buffer, so they are read-only. The index is read directly from the buffer, so opening a store
+// doesn't need memory proportional to the number of bitmaps.
+type StoreReader struct {
+	data   []byte
+	index  []byte
+	mapped bool
+}
+
+// NewStoreReader returns a StoreReader for the store in the given buffer. The buffer is not
+// copied.
+func NewStoreReader(data []byte) (*StoreReader, error) {
+	if len(data) < storeHeaderSize+storeTrailerSize {
+		return nil, errors.Errorf("store of %d bytes is too small", len(data))
+	}
+	if !bytes.Equal(data[:4], storeMagic) {
+		return nil, errors.Errorf("invalid store magic")
+	}
+	if data[4] == 0 || data[4] > storeVersion {
+		return nil, errors.Errorf("unsupported store version: %d", data[4])
+	}
+
+	trailer := data[len(data)-storeTrailerSize:]
+	if !bytes.Equal(trailer[20:24], storeMagic) {
+		return nil, errors.Errorf("invalid store trailer")
+	}
+	off := binary.LittleEndian.Uint64(trailer[0:8])
+	num := binary.LittleEndian.Uint64(trailer[8:16])
+	end := uint64(len(data) - storeTrailerSize)
+	if off < storeHeaderSize || off > end || (end-off)/storeEntrySize != num ||
+		(end-off)%storeEntrySize != 0 {
+		return nil, errors.Errorf("invalid store index at offset %d with %d entries", off, num)
+	}
+
+	sr := &StoreReader{data: data, index: data[off:end]}
+	if got, exp := checksum(sr.index), binary.LittleEndian.Uint32(trailer[16:20]); got != exp {
+		return nil, errors.Errorf("index checksum mismatch. Expected: %#x, got: %#x", exp, got)
+	}
+	for i := 0; i < sr.Len(); i++ {
+		e := sr.entry(i)
+		if i > 0 && e.id <= sr.entry(i-1).id {
+			return nil, errors.Errorf("store index is not sorted at entry %d", i)
+		}
+		if e.offset < storeHeaderSize || e.offset%8 != 0 || e.offset > off ||
+			e.length > off-e.offset {
+			return nil, errors.Errorf("invalid entry %d: offset %d, length %d", i, e.offset, e.length)
+		}
+	}
+	return sr, nil
+}
+
+// OpenStore maps the store at the given path into memory, and returns a StoreReader for it. The
+// store must be closed after use, and its bitmaps must not be used afterwards.
+func OpenStore(path string) (*StoreReader, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := NewStoreReader(data)
+	if err != nil {
+		if data != nil {
+			munmap(data)
+		}
+		return nil, errors.Wrapf(err, "while reading store %s", path)
+	}
+	sr.mapped = true
+	return sr, nil
+}
+
+// Close unmaps the store, if it was opened with OpenStore.
+func (sr *StoreReader) Close() error {
+	if !sr.mapped || sr.data == nil {
+		return nil
+	}
+	err := munmap(sr.data)
+	sr.data, sr.index = nil, nil
+	return err
+}
+
+// Len returns the number of bitmaps in the store.
+func (sr *StoreReader) Len() int {
+	return len(sr.index) / storeEntrySize
+}
+
+func (sr *StoreReader) entry(i int) storeEntry {
+	b := sr.index[i*storeEntrySize:]
+	return storeEntry{
+		id:     binary.LittleEndian.Uint64(b[0:8]),
+		offset: binary.LittleEndian.Uint64(b[8:16]),
+		length: binary.LittleEndian.Uint64(b[16:24]),
+		card:   binary.LittleEndian.Uint64(b[24:32]),
+	}
+}
+
+// find returns the index entry for the given id.
+func (sr *StoreReader) find(id uint64) (storeEntry, bool) {
+	i := sort.Search(sr.Len(), func(i int) bool {
+		return binary.LittleEndian.Uint64(sr.index[i*storeEntrySize:]) >= id
+	})
+	if i == sr.Len() {
+		return storeEntry{}, false
+	}
+	e := sr.entry(i)
+	return e, e.id == id
+}
+
+// IDs returns the ids of the bitmaps in the store, in increasing order.
+func (sr *StoreReader) IDs() []uint64 {
+	ids := make([]uint64, sr.Len())
+	for i := range ids {
+		ids[i] = sr.entry(i).id
+	}
+	return ids
+}
+
+// Cardinality returns the cardinality of the bitmap with the given id, without reading it.
+func (sr *StoreReader) Cardinality(id uint64) (int, error) {
+	e, ok := sr.find(id)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int(e.card), nil
+}
+
+// Get returns the bitmap with the given id. The bitmap refers to the store's buffer, and is
+// read-only. It returns ErrNotFound if the store doesn't have the bitmap. Like FromBuffer, Get
+// doesn't validate the bitmap, so use GetVerified if the store might be corrupt.
+func (sr *StoreReader) Get(id uint64) (*Bitmap, error) {
+	e, ok := sr.find(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	buf := sr.data[e.offset : e.offset+e.length]
+	h, body, err := readHeader(buf)
+	if err == nil && !hasHeader(buf) {
+		err = errors.Errorf("bitmap doesn't have a header")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading bitmap %d", id)
+	}
+	bm := fromBufferWithHeader(h, body)
+	bm.readOnly = true
+	return bm, nil
+}
+
+// GetVerified is the same as Get, but the bitmap is validated like FromBufferSafe does, so a
+// corrupt store returns an error instead of panicking.
+func (sr *StoreReader) GetVerified(id uint64) (*Bitmap, error) {
+	e, ok := sr.find(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	buf := sr.data[e.offset : e.offset+e.length]
+	if !hasHeader(buf) {
+		return nil, errors.Errorf("bitmap %d doesn't have a header", id)
+	}
+	bm, err := FromBufferSafe(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading bitmap %d", id)
+	}
+	bm.readOnly = true
+	return bm, nil
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sroar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	bitmaps := make(map[uint64]*Bitmap)
+	for i := 0; i < 100; i++ {
+		bm := NewBitmap()
+		for j := 0; j < rand.Intn(1000); j++ {
+			bm.Set(uint64(rand.Int63n(1 << 30)))
+		}
+		if i%10 == 0 {
+			bm.AddRange(1<<20, 1<<21)
+		}
+		bitmaps[uint64(rand.Int63())] = bm
+	}
+
+	var buf bytes.Buffer
+	sw, err := NewStoreWriter(&buf)
+	require.NoError(t, err)
+	for id, bm := range bitmaps {
+		require.NoError(t, sw.Add(id, bm))
+	}
+	for id := range bitmaps {
+		require.Error(t, sw.Add(id, NewBitmap()))
+		break
+	}
+	require.NoError(t, sw.Close())
+	require.Error(t, sw.Add(1, NewBitmap()))
+
+	check := func(sr *StoreReader) {
+		require.Equal(t, len(bitmaps), sr.Len())
+		ids := sr.IDs()
+		require.Len(t, ids, len(bitmaps))
+		for i := 1; i < len(ids); i++ {
+			require.Less(t, ids[i-1], ids[i])
+		}
+		for id, exp := range bitmaps {
+			bm, err := sr.Get(id)
+			require.NoError(t, err)
+			require.True(t, exp.Equals(bm))
+			require.NoError(t, bm.Verify())
+			require.PanicsWithValue(t, ErrReadOnly, func() { bm.Set(1) })
+			bm, err = sr.GetVerified(id)
+			require.NoError(t, err)
+			require.True(t, exp.Equals(bm))
+			require.PanicsWithValue(t, ErrReadOnly, func() { bm.Set(1) })
+
+			card, err := sr.Cardinality(id)
+			require.NoError(t, err)
+			require.Equal(t, exp.GetCardinality(), card)
+		}
+		_, err := sr.Get(uint64(rand.Int63()) | 1<<63)
+		require.Equal(t, ErrNotFound, err)
+		_, err = sr.GetVerified(uint64(rand.Int63()) | 1<<63)
+		require.Equal(t, ErrNotFound, err)
+		_, err = sr.Cardinality(uint64(rand.Int63()) | 1<<63)
+		require.Equal(t, ErrNotFound, err)
+	}
+
+	data := AlignedBuffer(buf.Len())
+	copy(data, buf.Bytes())
+	sr, err := NewStoreReader(data)
+	require.NoError(t, err)
+	check(sr)
+	require.NoError(t, sr.Close())
+
+	// Read the store through mmap.
+	path := filepath.Join(t.TempDir(), "store")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	bw := bufio.NewWriter(f)
+	sw, err = NewStoreWriter(bw)
+	require.NoError(t, err)
+	for id, bm := range bitmaps {
+		require.NoError(t, sw.Add(id, bm))
+	}
+	require.NoError(t, sw.Close())
+	require.NoError(t, bw.Flush())
+	require.NoError(t, f.Close())
+
+	sr, err = OpenStore(path)
+	require.NoError(t, err)
+	check(sr)
+	require.NoError(t, sr.Close())
+	require.NoError(t, sr.Close())
+}
+
+func TestStoreEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewStoreWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, sw.Add(5, NewBitmap()))
+	require.NoError(t, sw.Close())
+
+	sr, err := NewStoreReader(buf.Bytes())
+	require.NoError(t, err)
+	bm, err := sr.Get(5)
+	require.NoError(t, err)
+	require.True(t, bm.IsEmpty())
+
+	buf.Reset()
+	sw, err = NewStoreWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+	sr, err = NewStoreReader(buf.Bytes())
+	require.NoError(t, err)
+	require.Zero(t, sr.Len())
+}
+
+func TestStoreInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewStoreWriter(&buf)
+	require.NoError(t, err)
+	for i := uint64(0); i < 10; i++ {
+		require.NoError(t, sw.Add(i, FromRange(0, i*100)))
+	}
+	require.NoError(t, sw.Close())
+	data := buf.Bytes()
+
+	_, err = NewStoreReader(nil)
+	require.Error(t, err)
+	_, err = NewStoreReader(data[:len(data)-1])
+	require.Error(t, err)
+	_, err = NewStoreReader(FromRange(0, 100).ToBufferWithHeader())
+	require.Error(t, err)
+
+	// Corrupt the index.
+	cp := append([]byte{}, data...)
+	cp[len(cp)-storeTrailerSize-1] ^= 0x01
+	_, err = NewStoreReader(cp)
+	require.Error(t, err)
+
+	_, err = OpenStore(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	// Corrupt the bitmaps, keeping the index valid. Only GetVerified validates them.
+	sr, err := NewStoreReader(data)
+	require.NoError(t, err)
+	e, _ := sr.find(5)
+	cp = append([]byte{}, data...)
+	binary.LittleEndian.PutUint64(cp[e.offset+headerSize:], 1<<20)
+	sr, err = NewStoreReader(cp)
+	require.NoError(t, err)
+	_, err = sr.GetVerified(5)
+	require.Error(t, err)
+
+	// Truncate the bitmaps.
+	for _, length := range []uint64{0, headerSize, headerSize + 8, e.length / 2} {
+		cp = append([]byte{}, data...)
+		off := binary.LittleEndian.Uint64(cp[len(cp)-storeTrailerSize:])
+		index := cp[off : len(cp)-storeTrailerSize]
+		binary.LittleEndian.PutUint64(index[5*storeEntrySize+16:], length)
+		binary.LittleEndian.PutUint32(cp[len(cp)-8:], checksum(index))
+		sr, err = NewStoreReader(cp)
+		require.NoError(t, err)
+		_, err = sr.GetVerified(5)
+		require.Error(t, err, "length %d", length)
+	}
+}
@@ -60,6 +60,32 @@ func addUint64(a, b uint64) uint64 {
 	return a + b
 }
 
+// hostBigEndian is true if the host stores integers in big-endian byte order.
+var hostBigEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+// AlignedBuffer returns a byte slice of length n, which is 8-byte aligned. Bitmaps can be read in
+// place from such buffers, without copying them.
+func AlignedBuffer(n int) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	u64s := make([]uint64, (n+7)/8)
+	var bs []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
+	hdr.Len = n
+	hdr.Cap = n
+	hdr.Data = uintptr(unsafe.Pointer(&u64s[0]))
+	return bs
+}
+
+// isAligned returns true if the byte slice is 8-byte aligned.
+func isAligned(b []byte) bool {
+	return len(b) == 0 || uintptr(unsafe.Pointer(&b[0]))%8 == 0
+}
+
 func toByteSlice(b []uint16) []byte {
 	// reference: https://go101.org/article/unsafe.html
 	var bs []byte